@@ -0,0 +1,92 @@
+// Address based access control
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Allow and deny lists of networks.
+// Deny takes precedence, and an empty allow list allows all.
+type acl struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Parse comma separated CIDRs or single addresses
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var list []netip.Prefix
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, p.Masked())
+		} else {
+			a, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+		}
+	}
+	return list, nil
+}
+
+// Get allow and deny lists from options with the given prefix (e.g. client_allow and client_deny)
+func (o options) acl(prefix string) (acl, error) {
+	var a acl
+	var err error
+	if a.allow, err = parsePrefixes(o[prefix+"_allow"]); err != nil {
+		return a, fmt.Errorf("option %s_allow: %s", prefix, err)
+	}
+	if a.deny, err = parsePrefixes(o[prefix+"_deny"]); err != nil {
+		return a, fmt.Errorf("option %s_deny: %s", prefix, err)
+	}
+	return a, nil
+}
+
+// Check whether an address is permitted
+func (a acl) permit(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range a.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, p := range a.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get IP address of a TCP endpoint
+func addrIP(addr net.Addr) netip.Addr {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip, ok := netip.AddrFromSlice(tcpAddr.IP); ok {
+			return ip.Unmap()
+		}
+	}
+	return netip.Addr{}
+}
+
+// IP address of a remote address, empty if unknown
+func ipString(addr net.Addr) string {
+	if ip := addrIP(addr); ip.IsValid() {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,160 @@
+// Admin API
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Serve admin API in background if enabled.
+// Runtime metrics are published by expvar at /debug/vars.
+func startAdmin() {
+	if *adminAddr == "" {
+		return
+	}
+	http.HandleFunc("/rate", handleAdminRate)
+	http.HandleFunc("/usage", handleAdminUsage)
+	http.HandleFunc("/sessions", handleAdminSessions)
+	http.HandleFunc("/cluster", handleAdminCluster)
+	http.HandleFunc("/drain", handleAdminDrain)
+	http.HandleFunc("/resume", handleAdminResume)
+	http.HandleFunc("/stats", handleAdminStats)
+	http.HandleFunc("/history", handleAdminHistory)
+	nl, err := listen(*adminAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go func() {
+		lg.Printf("Admin API listening on %s", *adminAddr)
+		if err := http.Serve(nl, nil); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Fatalln(err)
+		}
+	}()
+}
+
+// Write a JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Get or set default bandwidth limits.
+// POST with form values global and/or session (e.g. session=1M) to change them.
+func handleAdminRate(w http.ResponseWriter, r *http.Request) {
+	globalRate, sessionRate := bandwidth.defaults()
+	if r.Method == http.MethodPost {
+		if v := r.FormValue("global"); v != "" {
+			n, err := parseSize(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			globalRate = n
+		}
+		if v := r.FormValue("session"); v != "" {
+			n, err := parseSize(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sessionRate = n
+		}
+		bandwidth.setDefaults(globalRate, sessionRate)
+		lg.Printf("Admin: default bandwidth changed to %d bytes/s globally and %d bytes/s per relay", globalRate, sessionRate)
+	}
+	writeJSON(w, map[string]int64{"global": globalRate, "session": sessionRate})
+}
+
+// Get relayed bytes of hostnames and rules in the current month
+func handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, usage.snapshot())
+}
+
+// Session in admin API output
+type adminSession struct {
+	Session       uint64 `json:"session"`
+	Hostname      string `json:"hostname"`
+	Suffix        string `json:"suffix,omitempty"`
+	Address       string `json:"address"` // server address for servers, client address for clients
+	Country       string `json:"country,omitempty"`
+	ASN           uint   `json:"asn,omitempty"`
+	ServerAddress string `json:"server_address,omitempty"` // server data session of a relay
+	ServerCountry string `json:"server_country,omitempty"`
+	ServerASN     uint   `json:"server_asn,omitempty"`
+	JA3           string `json:"ja3,omitempty"` // fingerprints of server or client
+	JA4           string `json:"ja4,omitempty"`
+}
+
+// Fill in address and location
+func (as *adminSession) setAddress(addr net.Addr) {
+	as.Address = addr.String()
+	if geo.enabled() {
+		loc := geo.lookup(addrIP(addr))
+		as.Country, as.ASN = loc.country, loc.asn
+	}
+}
+
+// Fill in TLS fingerprints if available
+func (as *adminSession) setFingerprint(h *clientHello) {
+	if h != nil {
+		as.JA3, as.JA4 = h.ja3, h.ja4
+	}
+}
+
+// Fill in server address and location of a relay
+func (as *adminSession) setServerAddress(addr net.Addr) {
+	as.ServerAddress = addr.String()
+	if geo.enabled() {
+		loc := geo.lookup(addrIP(addr))
+		as.ServerCountry, as.ServerASN = loc.country, loc.asn
+	}
+}
+
+// List online servers, pending and relaying clients
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	servers, pending, relaying := sessions.list()
+	writeJSON(w, map[string][]adminSession{"servers": servers, "pending": pending, "relaying": relaying})
+}
+
+// Get saved statistics of all hostnames, or one given by form value host
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	list, err := stats.query(r.FormValue("host"))
+	if errors.Is(err, errStatsDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// Find session records by form values host, ip, type (control, relay or client), from, to and limit.
+// Sessions active between from and to are listed, latest ended first.
+func handleAdminHistory(w http.ResponseWriter, r *http.Request) {
+	q, err := parseHistoryQuery(r.FormValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := history.query(q)
+	if errors.Is(err, errHistoryDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// List other nodes in the cluster and their servers
+func handleAdminCluster(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{"node": nodeID(), "nodes": cluster.nodes()})
+}
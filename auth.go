@@ -8,7 +8,10 @@ import (
 	"crypto/sha1"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"regexp"
 	"strings"
@@ -25,11 +28,29 @@ const (
 
 // Server credential with wildcard support
 type authInfo struct {
+	rule     string // hostname and suffix patterns as written, separated by a TAB
 	hostname *regexp.Regexp
 	suffix   *regexp.Regexp
 	method   authType
 	password string
 	cert     *x509.Certificate
+
+	// Optional settings
+	rate        int64       // bandwidth of each hostname in bytes per second
+	ruleRate    int64       // bandwidth of all hostnames matching the rule in bytes per second
+	sessionRate int64       // bandwidth of each relay session in bytes per second
+	quota       int64       // monthly relayed bytes of each hostname
+	ruleQuota   int64       // monthly relayed bytes of all hostnames matching the rule
+	quotaAction quotaAction // enforcement when a quota is exceeded
+	quotaRate   int64       // bandwidth in bytes per second when throttled by quota
+	maxRelays   int         // concurrent relays of each hostname
+	maxPending  int         // pending client requests of each hostname
+	connRate    float64     // new client connections per second of each hostname
+	clientACL   acl         // source addresses of VPN clients
+	serverACL   acl         // source addresses of VPN servers (azure clients)
+
+	fingerprints fingerprintPolicy // TLS fingerprints of VPN clients
+	clientCA     *x509.CertPool    // CAs of required VPN client certificates
 }
 
 // Server credential list
@@ -52,7 +73,7 @@ func (al *authList) read(file string) int {
 	scanner := bufio.NewScanner(f)
 
 	for scanner.Scan() {
-		// Format: hostname[TAB]suffix[TAB]authentication method[TAB]secret
+		// Format: hostname[TAB]suffix[TAB]authentication method[TAB]secret[TAB]options...
 		line := strings.Split(scanner.Text(), "	")
 
 		if len(line) < 3 {
@@ -73,14 +94,29 @@ func (al *authList) read(file string) int {
 			continue
 		}
 
+		info := authInfo{rule: strings.ToLower(line[0] + "\t" + line[1]), hostname: host, suffix: suffix, quotaAction: quotaCut}
+		if len(line) > 4 {
+			opts, ignored := parseOptions(line[4:])
+			if err := info.parseOptions(opts); err != nil {
+				lg.Event(slog.LevelError, "auth.invalid", fmt.Sprintf("auth: error parsing options for hostname %s of suffix %s: %s", line[0], line[1], err), "hostname", line[0], "suffix", line[1], "error", err.Error())
+				continue
+			}
+			for _, f := range ignored {
+				lg.Event(slog.LevelWarn, "auth.ignored", fmt.Sprintf("auth: ignoring field %s without value for hostname %s of suffix %s", f, line[0], line[1]), "hostname", line[0], "suffix", line[1], "field", f)
+			}
+		}
+
 		switch strings.ToLower(line[2]) {
 		case string(authNone):
-			al.list = append(al.list, authInfo{hostname: host, suffix: suffix, method: authNone})
+			info.method = authNone
+			al.list = append(al.list, info)
 		case string(authPassword):
 			if len(line) < 4 {
 				continue
 			}
-			al.list = append(al.list, authInfo{hostname: host, suffix: suffix, method: authPassword, password: line[3]})
+			info.method = authPassword
+			info.password = line[3]
+			al.list = append(al.list, info)
 		case string(authCert):
 			if len(line) < 4 {
 				continue
@@ -88,16 +124,18 @@ func (al *authList) read(file string) int {
 			if bytes, err := os.ReadFile(line[3]); err == nil {
 				block, _ := pem.Decode(bytes)
 				if block == nil {
-					lg.Printf("auth: error parsing certificate for hostname %s of suffix %s: not a valid PEM file", line[0], line[1])
+					lg.Event(slog.LevelError, "auth.invalid", fmt.Sprintf("auth: error parsing certificate for hostname %s of suffix %s: not a valid PEM file", line[0], line[1]), "hostname", line[0], "suffix", line[1], "error", "not a valid PEM file")
 					continue
 				}
 				if x509, err := x509.ParseCertificate(block.Bytes); err == nil {
-					al.list = append(al.list, authInfo{hostname: host, suffix: suffix, method: authCert, cert: x509})
+					info.method = authCert
+					info.cert = x509
+					al.list = append(al.list, info)
 				} else {
-					lg.Printf("auth: error parsing certificate for hostname %s of suffix %s: %s", line[0], line[1], err)
+					lg.Event(slog.LevelError, "auth.invalid", fmt.Sprintf("auth: error parsing certificate for hostname %s of suffix %s: %s", line[0], line[1], err), "hostname", line[0], "suffix", line[1], "error", err.Error())
 				}
 			} else {
-				lg.Printf("auth: error reading certificate for hostname %s of suffix %s: %s", line[0], line[1], err)
+				lg.Event(slog.LevelError, "auth.invalid", fmt.Sprintf("auth: error reading certificate for hostname %s of suffix %s: %s", line[0], line[1], err), "hostname", line[0], "suffix", line[1], "error", err.Error())
 			}
 		}
 	}
@@ -122,6 +160,61 @@ func (al *authList) find(fqdn string, suffix string) (*authInfo, bool) {
 	return nil, false
 }
 
+// Parse optional settings
+func (ai *authInfo) parseOptions(opts options) (err error) {
+	if ai.rate, err = opts.size("rate"); err != nil {
+		return err
+	}
+	if ai.ruleRate, err = opts.size("rule_rate"); err != nil {
+		return err
+	}
+	if ai.sessionRate, err = opts.size("session_rate"); err != nil {
+		return err
+	}
+	if ai.quota, err = opts.size("quota"); err != nil {
+		return err
+	}
+	if ai.ruleQuota, err = opts.size("rule_quota"); err != nil {
+		return err
+	}
+	if ai.quotaAction, err = parseQuotaAction(opts["quota_action"]); err != nil {
+		return err
+	}
+	if ai.quotaRate, err = opts.size("quota_rate"); err != nil {
+		return err
+	}
+	if ai.quotaAction == quotaThrottle && ai.quotaRate <= 0 {
+		return errors.New("quota_rate is required to throttle")
+	}
+	if ai.maxRelays, err = opts.int("max_relays"); err != nil {
+		return err
+	}
+	if ai.maxPending, err = opts.int("max_pending"); err != nil {
+		return err
+	}
+	if ai.connRate, err = opts.float("conn_rate"); err != nil {
+		return err
+	}
+	if ai.clientACL, err = opts.acl("client"); err != nil {
+		return err
+	}
+	if ai.serverACL, err = opts.acl("server"); err != nil {
+		return err
+	}
+	ai.fingerprints = opts.fingerprintPolicy("fp")
+	if file := opts["client_ca"]; file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		ai.clientCA = x509.NewCertPool()
+		if !ai.clientCA.AppendCertsFromPEM(b) {
+			return fmt.Errorf("option client_ca: no certificate found in %s", file)
+		}
+	}
+	return nil
+}
+
 // Match hostname and suffix with wildcard support
 func (ai *authInfo) match(hostname string, suffix string) bool {
 	return ai.hostname.MatchString(hostname) && ai.suffix.MatchString(suffix)
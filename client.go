@@ -3,41 +3,116 @@
 package main
 
 import (
-	"crypto/tls"
-	"io"
+	"errors"
 	"net"
 	"time"
 )
 
+var (
+	errClientNotAllowed   = errors.New("client address is not allowed")
+	errLocationNotAllowed = errors.New("client location is not allowed")
+	errClientFingerprint  = errors.New("client fingerprint is not allowed")
+	errClientCertificate  = errors.New("client certificate is required")
+)
+
 type clientCommand struct {
-	num  uint64
-	conn net.Conn
+	num  uint64          // server data session number
+	done <-chan struct{} // closed when the relay ends
 }
 
 // Handle new client connection
-func handleClient(num uint64, conn *tls.Conn, hostname string) {
-	lg.PrintSessionf("New client connection from %s for %s", num, 'C', 1, conn.RemoteAddr(), hostname)
+func handleClient(num uint64, conn net.Conn, hostname string, suffix string, l *listener) {
+	sess := lg.Session(num, 'C', "hostname", hostname, "suffix", suffix, "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name)
+	sess.Info("client.new", 1, "New client connection from %s for %s on %s%s", geo.describe(conn.RemoteAddr()), hostname, l.name, describeHello(conn))
+
+	// Refused clients are recorded here, relayed ones with their relay
+	start := time.Now()
+	var refused string
+	defer func() {
+		if refused != "" {
+			history.client(num, conn, hostname, suffix, start, refused)
+		}
+	}()
+
+	// Check client address and fingerprint before waking the server
+	if info, ok := auths.find(hostname, suffix); ok {
+		if !info.clientACL.permit(addrIP(conn.RemoteAddr())) {
+			metricClientRejected.Add(errClientNotAllowed.Error(), 1)
+			refused = errClientNotAllowed.Error()
+			sess.With("reason", refused).Warn("client.refused", 3, "Connection closed: %s", errClientNotAllowed)
+			return
+		}
+		if !info.fingerprints.permit(connHello(conn)) {
+			metricClientRejected.Add(errClientFingerprint.Error(), 1)
+			refused = errClientFingerprint.Error()
+			sess.With("reason", refused).Warn("client.refused", 3, "Connection closed: %s", errClientFingerprint)
+			return
+		}
+		// Verified during TLS handshake, missing if TLS is offloaded or CA is added later
+		if info.clientCA != nil {
+			certs := peerCertificates(conn)
+			if len(certs) == 0 {
+				metricClientRejected.Add(errClientCertificate.Error(), 1)
+				refused = errClientCertificate.Error()
+				sess.With("reason", refused).Warn("client.refused", 3, "Connection closed: %s", errClientCertificate)
+				return
+			}
+			sess.Info("client.certificate", 2, "Client certificate verified for %s", certs[0].Subject.CommonName)
+		}
+	}
+
+	// Check client location
+	var policy geoPolicy
+	if sfx := suffixes.get(suffix); sfx != nil {
+		policy = sfx.geoClient
+	}
+	if loc, ok := geo.permit(conn.RemoteAddr(), geoClient, policy); !ok {
+		metricClientRejected.Add(errLocationNotAllowed.Error(), 1)
+		refused = errLocationNotAllowed.Error()
+		sess.With("reason", refused).Warn("client.refused", 3, "Connection closed: %s (%s)", errLocationNotAllowed, loc)
+		return
+	}
+
+	// Check traffic quota
+	if err := usage.allow(hostname, suffix); err != nil {
+		metricClientRejected.Add(err.Error(), 1)
+		refused = err.Error()
+		sess.With("reason", refused).Warn("client.refused", 3, "Connection closed: %s", err)
+		return
+	}
 
 	// Find server control session
 	// buffered because channel might never be read
 	ch := make(chan clientCommand, 1)
-	if err := sessions.clientRequest(num, hostname, conn, ch); err != nil {
-		lg.PrintSessionf("Connection closed: %s", num, 'C', 3, err)
+	err := sessions.clientRequest(num, hostname, conn, ch)
+	if node, ok := cluster.lookup(hostname); ok && errors.Is(err, errServerOffline) {
+		err = requestRemote(num, hostname, suffix, conn, ch, node)
+	}
+	if err != nil {
+		if errors.Is(err, errServerRemote) {
+			metricClientRejected.Add(errServerRemote.Error(), 1)
+		} else {
+			metricClientRejected.Add(err.Error(), 1)
+		}
+		refused = err.Error()
+		sess.With("reason", refused).Warn("client.refused", 3, "Connection closed: %s", err)
 		return
 	}
-	lg.PrintSessionf("Waiting for server to connect", num, 'C', 2)
+	sess.Info("client.waiting", 2, "Waiting for server to connect")
 
 	// Wait for server to connect
 	timer := time.NewTimer(10 * time.Second)
 	defer timer.Stop()
 	select {
 	case s := <-ch:
-		lg.PrintSessionf("Relaying data from server session %d", num, 'C', 2, s.num)
-		n, _ := io.Copy(conn, s.conn)
-		lg.PrintSessionf("Client session closed: relayed %d bytes from server to client", num, 'C', 3, n)
+		sess = sess.With("server_session", s.num)
+		sess.Info("client.relaying", 2, "Relaying data via server session %d", s.num)
+		<-s.done
+		sess.Info("client.closed", 3, "Client session closed")
 	case <-timer.C:
 		// Timeout
-		lg.PrintSessionf("Connection closed: server did not respond", num, 'C', 3)
+		refused = "server did not respond"
+		sess.With("reason", refused).Warn("client.timeout", 3, "Connection closed: server did not respond")
 		sessions.delRequest(num)
 	}
 }
@@ -0,0 +1,115 @@
+// Server registrations shared by relay nodes
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+)
+
+var errServerRemote = errors.New("server is connected to another node")
+
+// Relay node and hostnames registered on it
+type clusterNode struct {
+	ID    string   `json:"id"`
+	Addr  string   `json:"addr"`            // cluster address
+	Relay string   `json:"relay,omitempty"` // address for data sessions of VPN servers
+	Load  int      `json:"load"`            // pending and relaying client sessions
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// Registry of servers across relay nodes.
+// Local servers are published and remote ones are looked up.
+type registry interface {
+	start(mux *http.ServeMux) error
+	stop() // leave the cluster
+	register(hostname string, suffix string)
+	unregister(hostname string)
+	lookup(hostname string) (clusterNode, bool) // remote node holding the control session
+	nodes() []clusterNode                       // remote nodes
+}
+
+// Available registry backends
+var registryBackends = map[string]func() registry{
+	"":       func() registry { return noRegistry{} },
+	"gossip": func() registry { return &gossipRegistry{} },
+}
+
+// Create registry by -cluster and serve other nodes
+func startCluster() (registry, error) {
+	backend, ok := registryBackends[*clusterBackend]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster backend %s", *clusterBackend)
+	}
+	r := backend()
+	if *clusterBackend == "" {
+		return r, r.start(nil)
+	}
+
+	// Any host reaching the cluster port could register servers and open relays
+	if *clusterSecret == "" {
+		return nil, errors.New("cluster secret is required")
+	}
+	if host, _, err := net.SplitHostPort(*clusterAddr); err != nil {
+		return nil, fmt.Errorf("cluster address: %w", err)
+	} else if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		return nil, errors.New("cluster address must be reachable by other nodes")
+	}
+	if *clusterRelay != "" {
+		if _, _, err := splitRelayAddr(*clusterRelay); err != nil {
+			return nil, fmt.Errorf("cluster relay address: %w", err)
+		}
+	}
+	localTag = nodeTag(nodeID())
+	listener, err := listen(*clusterAddr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/relay", handleNodeRelay)
+	mux.HandleFunc("/attach", handleNodeAttach)
+	if err := r.start(mux); err != nil {
+		return nil, err
+	}
+	go func() {
+		lg.Printf("Cluster node %s listening on %s", nodeID(), *clusterAddr)
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			lg.Event(slog.LevelError, "cluster.error", fmt.Sprintf("Cluster listener failed: %s", err), "error", err.Error())
+		}
+	}()
+	return r, nil
+}
+
+// ID of this node
+func nodeID() string {
+	if *clusterNodeID != "" {
+		return *clusterNodeID
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return *clusterAddr
+}
+
+// Single node without cluster
+type noRegistry struct{}
+
+func (noRegistry) start(*http.ServeMux) error        { return nil }
+func (noRegistry) stop()                             {}
+func (noRegistry) register(string, string)           {}
+func (noRegistry) unregister(string)                 {}
+func (noRegistry) lookup(string) (clusterNode, bool) { return clusterNode{}, false }
+func (noRegistry) nodes() []clusterNode              { return []clusterNode{} }
+
+// Sort nodes and their hostnames for output
+func sortNodes(nodes []clusterNode) {
+	for _, n := range nodes {
+		sort.Strings(n.Hosts)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+}
@@ -0,0 +1,92 @@
+// Commands to a running instance through the admin API
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var errUnknownCommand = errors.New("unknown command")
+
+// Admin API request of a command
+type command struct {
+	path string
+	post bool
+}
+
+// Available commands
+var commands = map[string]command{
+	"drain":   {path: "/drain", post: true},
+	"resume":  {path: "/resume", post: true},
+	"stats":   {path: "/stats"},
+	"history": {path: "/history"},
+}
+
+// Print commands in usage
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "Commands to a running instance, through the admin API given by -admin:")
+	fmt.Fprintln(os.Stderr, "  drain [hostname]")
+	fmt.Fprintln(os.Stderr, "        Refuse new clients of the node or a hostname, keeping relays and servers")
+	fmt.Fprintln(os.Stderr, "  resume [hostname]")
+	fmt.Fprintln(os.Stderr, "        Take new clients of the node or a hostname again")
+	fmt.Fprintln(os.Stderr, "  stats [hostname]")
+	fmt.Fprintln(os.Stderr, "        Show statistics of hostnames kept by -stats")
+	fmt.Fprintln(os.Stderr, "  history [hostname] [ip=address] [type=control|relay|client] [from=time] [to=time] [limit=n]")
+	fmt.Fprintln(os.Stderr, "        Show sessions recorded by -history, e.g. from=\"2006-01-02 15:04\" in local time")
+}
+
+// Run a command and print the response.
+// Arguments are key=value form values, a plain one is the hostname.
+func runCommand(args []string) error {
+	c, ok := commands[args[0]]
+	if !ok {
+		return errUnknownCommand
+	}
+	if *adminAddr == "" {
+		return errors.New("admin API address is needed")
+	}
+	form := url.Values{}
+	for _, arg := range args[1:] {
+		if k, v, ok := strings.Cut(arg, "="); ok {
+			form.Set(k, v)
+		} else {
+			form.Set("host", arg)
+		}
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	var resp *http.Response
+	var err error
+	if c.post {
+		resp, err = client.PostForm("http://"+*adminAddr+c.path, form)
+	} else {
+		resp, err = client.Get("http://" + *adminAddr + c.path + "?" + form.Encode())
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, b, "", "  ") != nil {
+		out.Reset()
+		out.Write(b)
+	}
+	fmt.Print(out.String())
+	return nil
+}
@@ -0,0 +1,57 @@
+// HTTP CONNECT front door for clients behind HTTP proxies
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var errConnectRefused = errors.New("CONNECT target refused")
+
+// Read a CONNECT request and accept it if the target matches a suffix.
+// Returns the tunneled connection and the requested hostname.
+func acceptConnect(conn net.Conn) (net.Conn, string, error) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.Method != http.MethodConnect {
+		writeConnectStatus(conn, http.StatusMethodNotAllowed)
+		return nil, "", fmt.Errorf("method %s is not allowed", req.Method)
+	}
+	host, _, err := net.SplitHostPort(req.RequestURI)
+	if err != nil {
+		writeConnectStatus(conn, http.StatusBadRequest)
+		return nil, "", err
+	}
+	host = strings.ToLower(host)
+	if _, _, _, ok := suffixes.parse(host); !ok {
+		writeConnectStatus(conn, http.StatusForbidden)
+		return nil, host, fmt.Errorf("%w: %s does not match any suffix", errConnectRefused, host)
+	}
+	if err := writeConnectStatus(conn, http.StatusOK); err != nil {
+		return nil, host, err
+	}
+
+	// Client may send TLS data without waiting for the response
+	var buffered []byte
+	if n := br.Buffered(); n > 0 {
+		buffered, _ = br.Peek(n)
+	}
+	return newPeekedConn(conn, buffered), host, nil
+}
+
+func writeConnectStatus(conn net.Conn, code int) error {
+	status := http.StatusText(code)
+	if code == http.StatusOK {
+		status = "Connection established"
+	}
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", code, status)
+	return err
+}
@@ -0,0 +1,43 @@
+// Local bbolt databases.
+// A database is only opened during a transaction so an upgraded process can share it.
+
+package main
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const dbLockTimeout = 5 * time.Second
+
+// Run a write transaction on a bucket, creating the database and bucket if needed
+func updateBucket(file string, name []byte, fn func(b *bolt.Bucket) error) error {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: dbLockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// Run a read transaction on a bucket if it exists
+func viewBucket(file string, name []byte, fn func(b *bolt.Bucket) error) error {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: dbLockTimeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(name); b != nil {
+			return fn(b)
+		}
+		return nil
+	})
+}
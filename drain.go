@@ -0,0 +1,181 @@
+// Draining and graceful shutdown
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reasons to refuse a client while draining
+var (
+	errNodeDraining = errors.New("node is draining")
+	errHostDraining = errors.New("hostname is draining")
+)
+
+// Node and hostnames that take no new clients.
+// Existing relays and server control sessions are kept.
+type drainList struct {
+	mu    sync.Mutex
+	node  bool
+	hosts map[string]bool
+}
+
+// Drain the node or a hostname if given
+func (dl *drainList) drain(hostname string) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if hostname == "" {
+		dl.node = true
+		return
+	}
+	if dl.hosts == nil {
+		dl.hosts = make(map[string]bool)
+	}
+	dl.hosts[hostname] = true
+}
+
+// Take new clients of the node or a hostname again
+func (dl *drainList) resume(hostname string) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if hostname == "" {
+		dl.node = false
+		return
+	}
+	delete(dl.hosts, hostname)
+}
+
+// Check whether new clients of a hostname are refused
+func (dl *drainList) check(hostname string) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.node {
+		return errNodeDraining
+	}
+	if dl.hosts[hostname] {
+		return errHostDraining
+	}
+	return nil
+}
+
+// Drain state in admin API output
+type drainState struct {
+	Node  bool     `json:"node"`
+	Hosts []string `json:"hosts"`
+}
+
+func (dl *drainList) state() drainState {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	s := drainState{Node: dl.node, Hosts: []string{}}
+	for hostname := range dl.hosts {
+		s.Hosts = append(s.Hosts, hostname)
+	}
+	sort.Strings(s.Hosts)
+	return s
+}
+
+// Get drain state.
+// POST to drain the node, or a hostname given by form value host.
+func handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		hostname := r.FormValue("host")
+		drains.drain(hostname)
+		if hostname == "" {
+			hostname = "node"
+		}
+		lg.Printf("Admin: draining %s", hostname)
+	}
+	writeJSON(w, drains.state())
+}
+
+// POST to take new clients of the node, or a hostname given by form value host, again
+func handleAdminResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hostname := r.FormValue("host")
+	drains.resume(hostname)
+	if hostname == "" {
+		hostname = "node"
+	}
+	lg.Printf("Admin: resumed %s", hostname)
+	writeJSON(w, drains.state())
+}
+
+// Stop accepting connections, let pending clients finish or fail and wait for relays until the shutdown timeout
+func shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	closeListeners()
+	cluster.stop()
+	drains.drain("") // connections accepted already
+	lg.Printf("Shutting down with %d servers and %d clients", len(sessions.serverHosts()), sessions.clientCount())
+
+	// Servers are needed until pending clients are done
+	waitSessions(ctx, sessions.pendingCount)
+	for _, hostname := range sessions.serverHosts() {
+		sessions.closeServer(hostname, "shutting down")
+	}
+	if !waitSessions(ctx, sessions.clientCount) {
+		lg.Event(slog.LevelWarn, "shutdown.timeout", fmt.Sprintf("Shutdown timeout, closing %d relays", sessions.clientCount()), "clients", sessions.clientCount())
+	}
+	waitControls(ctx)
+
+	saveStores()
+	lg.Println("Shut down")
+}
+
+// Save usage, statistics and session history before exiting
+func saveStores() {
+	if err := usage.flush(); err != nil {
+		lg.Event(slog.LevelError, "usage.save_failed", fmt.Sprintf("usage: error saving %s: %s", usage.file, err), "file", usage.file, "error", err.Error())
+	}
+	if err := stats.flush(); err != nil {
+		lg.Event(slog.LevelError, "stats.save_failed", fmt.Sprintf("stats: error saving %s: %s", stats.file, err), "file", stats.file, "error", err.Error())
+	}
+	if err := history.flush(); err != nil {
+		lg.Event(slog.LevelError, "history.save_failed", fmt.Sprintf("history: error saving %s: %s", history.file, err), "file", history.file, "error", err.Error())
+	}
+}
+
+// Wait for closed control sessions to be recorded
+func waitControls(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		controlSessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// Wait until no sessions are counted.
+// Returns false if the context is done first.
+func waitSessions(ctx context.Context, count func() int) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for count() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+// TLS ClientHello fingerprints (JA3 and JA4)
+//
+// https://github.com/salesforce/ja3
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// GREASE values are random and ignored by fingerprints
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(list []uint16) []uint16 {
+	var out []uint16
+	for _, v := range list {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Join values in decimal for JA3
+func joinDecimal[T uint8 | uint16](list []T) string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+// Join values in hex for JA4
+func joinHex(list []uint16) string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(s, ",")
+}
+
+// Truncated SHA-256 for JA4
+func hash12(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+// MD5 of version,ciphers,extensions,groups,point formats
+func (h *clientHello) fingerprintJA3() string {
+	s := strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinDecimal(withoutGREASE(h.ciphers)),
+		joinDecimal(withoutGREASE(h.extensions)),
+		joinDecimal(withoutGREASE(h.groups)),
+		joinDecimal(h.pointFormats),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 over TCP (e.g. t13d1516h2_8daaf6152771_e5627efa2ab1)
+func (h *clientHello) fingerprintJA4() string {
+	version := h.version
+	if versions := withoutGREASE(h.versions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	var v string
+	switch version {
+	case tls.VersionTLS13:
+		v = "13"
+	case tls.VersionTLS12:
+		v = "12"
+	case tls.VersionTLS11:
+		v = "11"
+	case tls.VersionTLS10:
+		v = "10"
+	case 0x0300:
+		v = "s3"
+	default:
+		v = "00"
+	}
+
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+	sni := "i"
+	if slices.Contains(extensions, extensionServerName) {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first, last := h.alpn[0][0], h.alpn[0][len(h.alpn[0])-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", v, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	slices.Sort(ciphers)
+	b := hash12(joinHex(ciphers))
+
+	// SNI and ALPN are left out as they are in the first part
+	var sorted []uint16
+	for _, e := range extensions {
+		if e != extensionServerName && e != extensionALPN {
+			sorted = append(sorted, e)
+		}
+	}
+	slices.Sort(sorted)
+	c := joinHex(sorted)
+	if c != "" && len(h.signatures) > 0 {
+		c += "_" + joinHex(withoutGREASE(h.signatures))
+	}
+	return a + "_" + b + "_" + hash12(c)
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Get the peeked ClientHello of a connection, nil if not available
+func connHello(conn net.Conn) *clientHello {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if pc, ok := conn.(*peekedConn); ok {
+		return pc.hello
+	}
+	return nil
+}
+
+// Describe fingerprints for logging
+func describeHello(conn net.Conn) string {
+	if h := connHello(conn); h != nil {
+		return fmt.Sprintf(" (JA3 %s, JA4 %s)", h.ja3, h.ja4)
+	}
+	return ""
+}
+
+// Allow and deny lists of fingerprints.
+// Entries are JA3 hashes or JA4 strings, and may end with * to match a prefix.
+type fingerprintPolicy struct {
+	allow []string
+	deny  []string
+}
+
+// Parse comma separated fingerprints
+func parseFingerprints(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Get allow and deny lists from options with the given prefix (e.g. fp_allow and fp_deny)
+func (o options) fingerprintPolicy(prefix string) fingerprintPolicy {
+	return fingerprintPolicy{allow: parseFingerprints(o[prefix+"_allow"]), deny: parseFingerprints(o[prefix+"_deny"])}
+}
+
+func matchFingerprint(list []string, h *clientHello) bool {
+	for _, v := range list {
+		if prefix, ok := strings.CutSuffix(v, "*"); ok {
+			if strings.HasPrefix(h.ja3, prefix) || strings.HasPrefix(h.ja4, prefix) {
+				return true
+			}
+		} else if v == h.ja3 || v == h.ja4 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a ClientHello is permitted.
+// Connections without fingerprint (e.g. TLS offloaded) are permitted unless an allow list is set.
+func (p fingerprintPolicy) permit(h *clientHello) bool {
+	if h == nil {
+		return len(p.allow) == 0
+	}
+	if matchFingerprint(p.deny, h) {
+		return false
+	}
+	return len(p.allow) == 0 || matchFingerprint(p.allow, h)
+}
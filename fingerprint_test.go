@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+)
+
+// Published JA3 example:
+// 769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0
+func ja3ExampleHello(grease bool) []byte {
+	ciphers := []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4}
+	extensions := []testExtension{
+		sniExtension("vpn1.myazure.net"),
+		uint16ListExtension(extensionGroups, 23, 24, 25),
+		pointFormatsExtension(0),
+	}
+	if grease {
+		ciphers = append([]uint16{0x0a0a}, ciphers...)
+		extensions = append([]testExtension{{0x1a1a, nil}}, extensions...)
+		extensions[2] = uint16ListExtension(extensionGroups, 0x2a2a, 23, 24, 25)
+		extensions = append(extensions, testExtension{0xfafa, []byte{0}})
+	}
+	return buildHello(tls.VersionTLS10, ciphers, extensions)
+}
+
+// Published JA4 example t13d1516h2_8daaf6152771_e5627efa2ab1 with ciphers and extensions in Chrome order
+func ja4ExampleHello(reverse bool) []byte {
+	ciphers := []uint16{0x4a4a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	extensions := []testExtension{
+		{0x3a3a, nil},
+		sniExtension("vpn1.myazure.net"),
+		{0x0017, nil},
+		{0xff01, []byte{0}},
+		uint16ListExtension(extensionGroups, 0x8a8a, 0x001d, 0x0017, 0x0018),
+		pointFormatsExtension(0),
+		{0x0023, nil},
+		alpnExtension("h2", "http/1.1"),
+		{0x0005, []byte{1, 0, 0, 0, 0}},
+		uint16ListExtension(extensionSignatureAlgs, 0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601),
+		{0x0012, nil},
+		{0x0033, nil},
+		{0x002d, []byte{1, 1}},
+		versionsExtension(0x7a7a, tls.VersionTLS13, tls.VersionTLS12),
+		{0x001b, []byte{2, 0, 2}},
+		{0x4469, nil},
+		{0x0015, []byte{0, 0}},
+		{0xdada, []byte{0}},
+	}
+	if reverse {
+		slices.Reverse(ciphers)
+		slices.Reverse(extensions)
+	}
+	return buildHello(tls.VersionTLS12, ciphers, extensions)
+}
+
+func parseTestHello(t *testing.T, body []byte) *clientHello {
+	t.Helper()
+	hello, ok := parseClientHello(body)
+	if !ok {
+		t.Fatal("failed to parse")
+	}
+	return hello
+}
+
+func TestFingerprintJA3(t *testing.T) {
+	const want = "ada70206e40642a3e4461f35503241d5"
+	if got := parseTestHello(t, ja3ExampleHello(false)).fingerprintJA3(); got != want {
+		t.Errorf("JA3 %s, want %s", got, want)
+	}
+	if got := parseTestHello(t, ja3ExampleHello(true)).fingerprintJA3(); got != want {
+		t.Errorf("JA3 with GREASE %s, want %s", got, want)
+	}
+}
+
+func TestFingerprintJA4(t *testing.T) {
+	const want = "t13d1516h2_8daaf6152771_e5627efa2ab1"
+	hello := parseTestHello(t, ja4ExampleHello(false))
+	if got := hello.fingerprintJA4(); got != want {
+		t.Errorf("JA4 %s, want %s", got, want)
+	}
+
+	// Ciphers and extensions are sorted by JA4 but not by JA3
+	reversed := parseTestHello(t, ja4ExampleHello(true))
+	if got := reversed.fingerprintJA4(); got != want {
+		t.Errorf("JA4 in reverse order %s, want %s", got, want)
+	}
+	if reversed.fingerprintJA3() == hello.fingerprintJA3() {
+		t.Error("JA3 does not depend on order")
+	}
+}
+
+func TestFingerprintJA4Prefix(t *testing.T) {
+	ciphers := []uint16{tls.TLS_AES_128_GCM_SHA256}
+	tests := []struct {
+		name       string
+		version    uint16
+		extensions []testExtension
+		want       string
+	}{
+		{name: "IP address", version: tls.VersionTLS12, extensions: []testExtension{alpnExtension("h2")}, want: "t12i0101h2"},
+		{name: "domain", version: tls.VersionTLS12, extensions: []testExtension{sniExtension("vpn1.myazure.net")}, want: "t12d010100"},
+		{name: "supported versions", version: tls.VersionTLS12, extensions: []testExtension{versionsExtension(0x0a0a, tls.VersionTLS12, tls.VersionTLS13)}, want: "t13i010100"},
+		{name: "legacy version", version: 0x0300, extensions: []testExtension{}, want: "ts3i010000"},
+		{name: "unknown version", version: 0x7f00, extensions: []testExtension{}, want: "t00i010000"},
+		{name: "ALPN http/1.1", version: tls.VersionTLS12, extensions: []testExtension{alpnExtension("http/1.1", "h2")}, want: "t12i0101h1"},
+		{name: "ALPN single character", version: tls.VersionTLS12, extensions: []testExtension{alpnExtension("x")}, want: "t12i0101xx"},
+		{name: "ALPN not alphanumeric", version: tls.VersionTLS12, extensions: []testExtension{alpnExtension("\xab\xcd")}, want: "t12i0101ad"},
+		{name: "ALPN last not alphanumeric", version: tls.VersionTLS12, extensions: []testExtension{alpnExtension("h/")}, want: "t12i01016f"},
+		{name: "ALPN empty", version: tls.VersionTLS12, extensions: []testExtension{alpnExtension("")}, want: "t12i010100"},
+		{name: "GREASE extensions", version: tls.VersionTLS12, extensions: []testExtension{{0x0a0a, nil}, {0xfafa, nil}}, want: "t12i010000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseTestHello(t, buildHello(tt.version, ciphers, tt.extensions)).fingerprintJA4()
+			if got[:10] != tt.want {
+				t.Errorf("JA4 %s, want prefix %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGREASE(t *testing.T) {
+	for i := range 16 {
+		v := uint16(i<<12 | 0x0a00 | i<<4 | 0x0a)
+		if !isGREASE(v) {
+			t.Errorf("%04x is GREASE", v)
+		}
+	}
+	for _, v := range []uint16{0x0000, 0x0a0b, 0x1a2a, 0x0a1a, 0x1301, 0xabab} {
+		if isGREASE(v) {
+			t.Errorf("%04x is not GREASE", v)
+		}
+	}
+}
+
+func TestFingerprintPolicy(t *testing.T) {
+	hello := parseTestHello(t, ja4ExampleHello(false))
+	hello.ja3, hello.ja4 = hello.fingerprintJA3(), hello.fingerprintJA4()
+	tests := []struct {
+		name   string
+		policy fingerprintPolicy
+		hello  *clientHello
+		want   bool
+	}{
+		{name: "empty", want: true, hello: hello},
+		{name: "deny JA4", policy: fingerprintPolicy{deny: parseFingerprints("T13D1516H2_8DAAF6152771_E5627EFA2AB1")}, hello: hello},
+		{name: "deny JA4 prefix", policy: fingerprintPolicy{deny: parseFingerprints("x, t13d1516h2_*")}, hello: hello},
+		{name: "deny JA3", policy: fingerprintPolicy{deny: parseFingerprints(hello.ja3)}, hello: hello},
+		{name: "deny other", policy: fingerprintPolicy{deny: parseFingerprints("t12*")}, hello: hello, want: true},
+		{name: "allow", policy: fingerprintPolicy{allow: parseFingerprints("t13d*")}, hello: hello, want: true},
+		{name: "allow other", policy: fingerprintPolicy{allow: parseFingerprints("t12d*")}, hello: hello},
+		{name: "deny before allow", policy: fingerprintPolicy{allow: parseFingerprints("t13d*"), deny: parseFingerprints(hello.ja3)}, hello: hello},
+		{name: "no hello", policy: fingerprintPolicy{deny: parseFingerprints("t13d*")}, want: true},
+		{name: "no hello with allow list", policy: fingerprintPolicy{allow: parseFingerprints("t13d*")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.permit(tt.hello); got != tt.want {
+				t.Errorf("permit %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+// GeoIP lookup and location based admission
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	geoCheckInterval = time.Minute
+	geoUnknown       = "ZZ" // country of addresses not in the database
+)
+
+// Location of an address
+type geoLocation struct {
+	country string // ISO country code
+	asn     uint   // autonomous system number, 0 if unknown
+}
+
+// Fields read from country and ASN databases
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// Allow and deny lists of country codes and AS numbers (e.g. JP, AS64500).
+// Deny takes precedence, and an empty allow list allows all.
+type geoPolicy struct {
+	allow []string
+	deny  []string
+}
+
+// MaxMind format databases, reloaded when changed
+type geoDB struct {
+	files   []string
+	readers []*maxminddb.Reader
+	mtimes  []time.Time
+	rw      sync.RWMutex
+}
+
+// Open comma separated database files and watch for changes
+func (g *geoDB) open(files string) error {
+	for _, f := range strings.Split(files, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			g.files = append(g.files, f)
+		}
+	}
+	if len(g.files) == 0 {
+		return nil
+	}
+	g.readers = make([]*maxminddb.Reader, len(g.files))
+	g.mtimes = make([]time.Time, len(g.files))
+	for i := range g.files {
+		if err := g.load(i); err != nil {
+			return err
+		}
+	}
+	go func() {
+		for range time.Tick(geoCheckInterval) {
+			g.reload()
+		}
+	}()
+	return nil
+}
+
+// Load a database file
+func (g *geoDB) load(i int) error {
+	info, err := os.Stat(g.files[i])
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(g.files[i])
+	if err != nil {
+		return err
+	}
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return fmt.Errorf("%s: %s", g.files[i], err)
+	}
+	g.rw.Lock()
+	g.readers[i] = r
+	g.mtimes[i] = info.ModTime()
+	g.rw.Unlock()
+	return nil
+}
+
+// Reload changed database files
+func (g *geoDB) reload() {
+	for i, f := range g.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		g.rw.RLock()
+		changed := !info.ModTime().Equal(g.mtimes[i])
+		g.rw.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := g.load(i); err != nil {
+			lg.Event(slog.LevelError, "geoip.reload_failed", fmt.Sprintf("geoip: error reloading database: %s", err), "error", err.Error())
+		} else {
+			lg.Printf("geoip: reloaded %s", f)
+		}
+	}
+}
+
+// Check whether any database is loaded
+func (g *geoDB) enabled() bool {
+	return len(g.files) > 0
+}
+
+// Look up location of an address
+func (g *geoDB) lookup(ip netip.Addr) geoLocation {
+	loc := geoLocation{country: geoUnknown}
+	if !g.enabled() || !ip.IsValid() {
+		return loc
+	}
+	g.rw.RLock()
+	defer g.rw.RUnlock()
+	for _, r := range g.readers {
+		var rec geoRecord
+		if err := r.Lookup(net.IP(ip.AsSlice()), &rec); err != nil {
+			continue
+		}
+		if rec.Country.ISOCode != "" {
+			loc.country = strings.ToUpper(rec.Country.ISOCode)
+		}
+		if rec.ASN != 0 {
+			loc.asn = rec.ASN
+		}
+	}
+	return loc
+}
+
+// Describe a remote address with its location for logging
+func (g *geoDB) describe(addr net.Addr) string {
+	if !g.enabled() {
+		return addr.String()
+	}
+	return fmt.Sprintf("%s (%s)", addr, g.lookup(addrIP(addr)))
+}
+
+// Check an address against policies, all of which must permit it
+func (g *geoDB) permit(addr net.Addr, policies ...geoPolicy) (geoLocation, bool) {
+	loc := g.lookup(addrIP(addr))
+	if !g.enabled() {
+		return loc, true
+	}
+	for _, p := range policies {
+		if !p.permit(loc) {
+			return loc, false
+		}
+	}
+	return loc, true
+}
+
+func (loc geoLocation) String() string {
+	if loc.asn == 0 {
+		return loc.country
+	}
+	return fmt.Sprintf("%s AS%d", loc.country, loc.asn)
+}
+
+// Parse comma separated country codes and AS numbers
+func parseGeoList(s string) ([]string, error) {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		if n, ok := strings.CutPrefix(v, "AS"); ok && len(v) > 2 {
+			if _, err := strconv.ParseUint(n, 10, 32); err != nil {
+				return nil, fmt.Errorf("invalid AS number %s", v)
+			}
+		} else if len(v) != 2 {
+			return nil, fmt.Errorf("invalid country code %s", v)
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// Parse allow and deny lists
+func parseGeoPolicy(allow, deny string) (geoPolicy, error) {
+	var p geoPolicy
+	var err error
+	if p.allow, err = parseGeoList(allow); err != nil {
+		return p, err
+	}
+	if p.deny, err = parseGeoList(deny); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// Get location policy from options with the given prefix (e.g. geo_client_allow and geo_client_deny)
+func (o options) geoPolicy(prefix string) (geoPolicy, error) {
+	p, err := parseGeoPolicy(o[prefix+"_allow"], o[prefix+"_deny"])
+	if err != nil {
+		return p, fmt.Errorf("option %s: %s", prefix, err)
+	}
+	return p, nil
+}
+
+// Check whether the policy has any entries
+func (p geoPolicy) set() bool {
+	return len(p.allow) > 0 || len(p.deny) > 0
+}
+
+// Check that location policies have a database, without one they would permit all addresses
+func checkGeoPolicies() error {
+	if geo.enabled() {
+		return nil
+	}
+	if geoClient.set() || geoServer.set() {
+		return errors.New("location policies need a GeoIP database (-geoip)")
+	}
+	if s := suffixes.geoPolicy(); s != "" {
+		return fmt.Errorf("location policy of suffix %s needs a GeoIP database (-geoip)", s)
+	}
+	return nil
+}
+
+// Check whether a location is permitted
+func (p geoPolicy) permit(loc geoLocation) bool {
+	asn := fmt.Sprintf("AS%d", loc.asn)
+	match := func(v string) bool {
+		return v == loc.country || (loc.asn != 0 && v == asn)
+	}
+	for _, v := range p.deny {
+		if match(v) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, v := range p.allow {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
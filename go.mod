@@ -4,4 +4,11 @@ go 1.23.0
 
 toolchain go1.24.1
 
-require golang.org/x/crypto v0.36.0
+require (
+	github.com/oschwald/maxminddb-golang v1.13.1
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.36.0
+	golang.org/x/time v0.9.0
+)
+
+require golang.org/x/sys v0.31.0 // indirect
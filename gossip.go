@@ -0,0 +1,292 @@
+// Gossip registry backend.
+//
+// Every node periodically pushes all node states it knows to its peers over HTTP
+// and merges the states they reply with, so nodes learn about each other
+// even without a full list of peers.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gossipInterval = 2 * time.Second
+	gossipTimeout  = time.Second
+	nodeTimeout    = 5 * gossipInterval // remove nodes without heartbeat
+	leftTimeout    = 2 * nodeTimeout    // ignore relayed states of removed nodes
+	maxGossipSize  = 16 << 20
+)
+
+// State of a node exchanged between nodes
+type nodeState struct {
+	ID      string            `json:"id"`
+	Addr    string            `json:"addr"`    // cluster address
+	Relay   string            `json:"relay"`   // address for data sessions of VPN servers
+	Load    int               `json:"load"`    // pending and relaying client sessions
+	Version int64             `json:"version"` // heartbeat counter, only compared with the same node
+	Hosts   map[string]string `json:"hosts"`   // registered hostnames and their suffixes
+}
+
+// Remote node with local receive times
+type gossipNode struct {
+	state   nodeState
+	updated time.Time            // last newer version
+	since   map[string]time.Time // registration of each hostname
+}
+
+// Last version of a removed node
+type leftNode struct {
+	version int64
+	removed time.Time
+}
+
+type gossipRegistry struct {
+	mu       sync.Mutex
+	self     nodeState
+	peers    map[string]*gossipNode // remote nodes by ID
+	left     map[string]leftNode    // removed nodes by ID
+	changed  chan struct{}          // local registrations changed
+	stopped  chan struct{}
+	stopOnce sync.Once
+	client   *http.Client
+}
+
+func (g *gossipRegistry) start(mux *http.ServeMux) error {
+	// Start above versions of a previous process of the node
+	g.self = nodeState{ID: nodeID(), Addr: *clusterAddr, Relay: *clusterRelay, Version: time.Now().UnixNano(), Hosts: make(map[string]string)}
+	g.peers = make(map[string]*gossipNode)
+	g.left = make(map[string]leftNode)
+	g.changed = make(chan struct{}, 1)
+	g.stopped = make(chan struct{})
+	g.client = &http.Client{Timeout: gossipTimeout}
+	mux.HandleFunc("/gossip", g.handleGossip)
+	go g.run()
+	return nil
+}
+
+func (g *gossipRegistry) register(hostname string, suffix string) {
+	g.mu.Lock()
+	g.self.Hosts[hostname] = suffix
+	g.mu.Unlock()
+	g.notify()
+}
+
+func (g *gossipRegistry) unregister(hostname string) {
+	g.mu.Lock()
+	delete(g.self.Hosts, hostname)
+	g.mu.Unlock()
+	g.notify()
+}
+
+// Stop gossiping, other nodes remove this one after the node timeout
+func (g *gossipRegistry) stop() {
+	g.stopOnce.Do(func() { close(g.stopped) })
+}
+
+// Gossip early after local changes
+func (g *gossipRegistry) notify() {
+	select {
+	case g.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (g *gossipRegistry) lookup(hostname string) (clusterNode, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Latest registration wins if a server has just moved
+	var found *gossipNode
+	for _, n := range g.peers {
+		if _, ok := n.state.Hosts[hostname]; ok && (found == nil || n.since[hostname].After(found.since[hostname])) {
+			found = n
+		}
+	}
+	if found == nil {
+		return clusterNode{}, false
+	}
+	return clusterNode{ID: found.state.ID, Addr: found.state.Addr, Relay: found.state.Relay, Load: found.state.Load}, true
+}
+
+func (g *gossipRegistry) nodes() []clusterNode {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	list := make([]clusterNode, 0, len(g.peers))
+	for _, n := range g.peers {
+		node := clusterNode{ID: n.state.ID, Addr: n.state.Addr, Relay: n.state.Relay, Load: n.state.Load, Hosts: []string{}}
+		for hostname := range n.state.Hosts {
+			node.Hosts = append(node.Hosts, hostname)
+		}
+		list = append(list, node)
+	}
+	sortNodes(list)
+	return list
+}
+
+// Exchange states with peers periodically
+func (g *gossipRegistry) run() {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-g.changed:
+		case <-g.stopped:
+			return
+		}
+		states, targets := g.prepare()
+		for _, target := range targets {
+			go g.exchange(target, states)
+		}
+	}
+}
+
+// Bump heartbeat, expire silent nodes and collect gossip targets
+func (g *gossipRegistry) prepare() ([]byte, []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.self.Version++
+	g.self.Load = sessions.clientCount()
+	for id, n := range g.peers {
+		if now.Sub(n.updated) > nodeTimeout {
+			delete(g.peers, id)
+			g.left[id] = leftNode{version: n.state.Version, removed: now}
+			lg.Event(slog.LevelWarn, "cluster.node_left", fmt.Sprintf("Cluster node %s at %s left", id, n.state.Addr), "node", id, "addr", n.state.Addr)
+		}
+	}
+	for id, n := range g.left {
+		if now.Sub(n.removed) > leftTimeout {
+			delete(g.left, id)
+		}
+	}
+
+	// Configured peers and all known nodes
+	seen := map[string]bool{g.self.Addr: true}
+	var targets []string
+	for _, addr := range strings.Split(*clusterPeers, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" && !seen[addr] {
+			seen[addr] = true
+			targets = append(targets, addr)
+		}
+	}
+	for _, n := range g.peers {
+		if !seen[n.state.Addr] {
+			seen[n.state.Addr] = true
+			targets = append(targets, n.state.Addr)
+		}
+	}
+
+	b, _ := json.Marshal(g.states())
+	return b, targets
+}
+
+// All known states.
+// Must be called with lock held.
+func (g *gossipRegistry) states() []nodeState {
+	states := []nodeState{g.self}
+	for _, n := range g.peers {
+		states = append(states, n.state)
+	}
+	return states
+}
+
+// Push states to a peer and merge its reply
+func (g *gossipRegistry) exchange(target string, states []byte) {
+	req, err := http.NewRequest(http.MethodPost, "http://"+target+"/gossip", bytes.NewReader(states))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+*clusterSecret)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		lg.Event(slog.LevelWarn, "cluster.gossip_failed", fmt.Sprintf("Cluster gossip to %s failed: %s", target, resp.Status), "peer", target, "status", resp.StatusCode)
+		return
+	}
+	var reply []nodeState
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxGossipSize)).Decode(&reply); err == nil {
+		g.merge(reply)
+	}
+}
+
+// Receive states from a peer and reply with ours
+func (g *gossipRegistry) handleGossip(w http.ResponseWriter, r *http.Request) {
+	if !clusterAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var states []nodeState
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGossipSize)).Decode(&states); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.merge(states)
+
+	g.mu.Lock()
+	states = g.states()
+	g.mu.Unlock()
+	writeJSON(w, states)
+}
+
+// Keep newer states of remote nodes
+func (g *gossipRegistry) merge(states []nodeState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Freshness is judged by local receive time as clocks of nodes may differ
+	now := time.Now()
+	for _, s := range states {
+		if s.ID == "" || s.ID == g.self.ID {
+			continue
+		}
+		// Stale states relayed by other nodes must not revive nodes that left
+		if l, ok := g.left[s.ID]; ok {
+			if s.Version <= l.version {
+				continue
+			}
+			delete(g.left, s.ID)
+		}
+		n, ok := g.peers[s.ID]
+		if !ok {
+			lg.Printf("Cluster node %s at %s joined", s.ID, s.Addr)
+			n = &gossipNode{since: make(map[string]time.Time)}
+			g.peers[s.ID] = n
+		} else if s.Version <= n.state.Version {
+			continue
+		}
+		for hostname := range s.Hosts {
+			if _, ok := n.state.Hosts[hostname]; !ok {
+				n.since[hostname] = now
+			}
+		}
+		for hostname := range n.since {
+			if _, ok := s.Hosts[hostname]; !ok {
+				delete(n.since, hostname)
+			}
+		}
+		n.state, n.updated = s, now
+	}
+}
+
+// Check shared secret of a request between nodes
+func clusterAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(*clusterSecret)) == 1
+}
@@ -0,0 +1,213 @@
+// Peeking TLS ClientHello before handshake
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	recordTypeHandshake    = 22
+	handshakeClientHello   = 1
+	extensionServerName    = 0
+	extensionGroups        = 10
+	extensionPointFormats  = 11
+	extensionSignatureAlgs = 13
+	extensionALPN          = 16
+	extensionVersions      = 43
+	maxClientHelloSize     = 64 * 1024
+	maxTLSPlaintextPayload = 16384
+)
+
+// Bytes that are not a valid ClientHello, as opposed to read errors
+var errInvalidHello = errors.New("invalid ClientHello")
+
+// Fields of a ClientHello
+type clientHello struct {
+	serverName   string
+	version      uint16   // legacy version
+	versions     []uint16 // supported versions
+	ciphers      []uint16
+	extensions   []uint16 // extension types in order
+	groups       []uint16
+	pointFormats []uint8
+	signatures   []uint16 // signature algorithms
+	alpn         []string
+	ja3, ja4     string // fingerprints
+}
+
+// Connection replaying peeked bytes before reading further
+type peekedConn struct {
+	net.Conn
+	r     io.Reader
+	hello *clientHello // peeked ClientHello if any
+}
+
+func newPeekedConn(conn net.Conn, peeked []byte) *peekedConn {
+	return &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked), conn)}
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Shut down the writing side of the underlying connection
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
+
+// Read records until a full ClientHello is received.
+// Returns the parsed message and all bytes read.
+func peekClientHello(conn net.Conn) (*clientHello, []byte, error) {
+	var peeked, msg []byte
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, peeked, err
+		}
+		peeked = append(peeked, header...)
+		if header[0] != recordTypeHandshake {
+			return nil, peeked, fmt.Errorf("%w: not a TLS handshake", errInvalidHello)
+		}
+		n := int(binary.BigEndian.Uint16(header[3:]))
+		if n == 0 || n > maxTLSPlaintextPayload {
+			return nil, peeked, fmt.Errorf("%w: invalid TLS record length", errInvalidHello)
+		}
+		fragment := make([]byte, n)
+		if _, err := io.ReadFull(conn, fragment); err != nil {
+			return nil, peeked, err
+		}
+		peeked = append(peeked, fragment...)
+		msg = append(msg, fragment...)
+
+		// Handshake message may span multiple records
+		if len(msg) >= 4 {
+			if msg[0] != handshakeClientHello {
+				return nil, peeked, fmt.Errorf("%w: not a ClientHello", errInvalidHello)
+			}
+			size := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if size > maxClientHelloSize {
+				return nil, peeked, fmt.Errorf("%w: too large", errInvalidHello)
+			}
+			if len(msg) >= size {
+				hello, ok := parseClientHello(msg[4:size])
+				if !ok {
+					return nil, peeked, errInvalidHello
+				}
+				hello.ja3, hello.ja4 = hello.fingerprintJA3(), hello.fingerprintJA4()
+				return hello, peeked, nil
+			}
+		}
+	}
+}
+
+// Parse ClientHello body
+func parseClientHello(body []byte) (*clientHello, bool) {
+	var ok bool
+	hello := &clientHello{}
+	s := cryptobyte.String(body)
+	var random, sessionID, ciphers, compression cryptobyte.String
+	if !s.ReadUint16(&hello.version) || !s.ReadBytes((*[]byte)(&random), 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || !s.ReadUint16LengthPrefixed(&ciphers) ||
+		!s.ReadUint8LengthPrefixed(&compression) {
+		return nil, false
+	}
+	if hello.ciphers, ok = readUint16List(ciphers); !ok {
+		return nil, false
+	}
+	if s.Empty() {
+		// No extensions
+		return hello, true
+	}
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() {
+		return nil, false
+	}
+	for !extensions.Empty() {
+		var ext uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&ext) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, false
+		}
+		hello.extensions = append(hello.extensions, ext)
+		var list cryptobyte.String
+		switch ext {
+		case extensionServerName:
+			var names cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&names) {
+				return nil, false
+			}
+			for !names.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+					return nil, false
+				}
+				if nameType == 0 {
+					hello.serverName = string(name)
+				}
+			}
+		case extensionGroups:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return nil, false
+			}
+			if hello.groups, ok = readUint16List(list); !ok {
+				return nil, false
+			}
+		case extensionPointFormats:
+			if !data.ReadUint8LengthPrefixed(&list) {
+				return nil, false
+			}
+			hello.pointFormats = list
+		case extensionSignatureAlgs:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return nil, false
+			}
+			if hello.signatures, ok = readUint16List(list); !ok {
+				return nil, false
+			}
+		case extensionALPN:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return nil, false
+			}
+			for !list.Empty() {
+				var proto cryptobyte.String
+				if !list.ReadUint8LengthPrefixed(&proto) {
+					return nil, false
+				}
+				hello.alpn = append(hello.alpn, string(proto))
+			}
+		case extensionVersions:
+			if !data.ReadUint8LengthPrefixed(&list) {
+				return nil, false
+			}
+			if hello.versions, ok = readUint16List(list); !ok {
+				return nil, false
+			}
+		}
+	}
+	return hello, true
+}
+
+// Read a list of 16-bit values
+func readUint16List(s cryptobyte.String) ([]uint16, bool) {
+	var list []uint16
+	for !s.Empty() {
+		var v uint16
+		if !s.ReadUint16(&v) {
+			return nil, false
+		}
+		list = append(list, v)
+	}
+	return list, true
+}
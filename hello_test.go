@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Extension of a test ClientHello
+type testExtension struct {
+	typ  uint16
+	data []byte
+}
+
+// Build a ClientHello body, without extensions block if extensions is nil
+func buildHello(version uint16, ciphers []uint16, extensions []testExtension) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(version)
+	b.AddBytes(make([]byte, 32))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, c := range ciphers {
+			b.AddUint16(c)
+		}
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+	if extensions != nil {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, e := range extensions {
+				b.AddUint16(e.typ)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(e.data) })
+			}
+		})
+	}
+	return b.BytesOrPanic()
+}
+
+// Wrap a ClientHello body in a handshake message split into records of at most size bytes
+func helloRecords(body []byte, size int) []byte {
+	msg := append([]byte{handshakeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	var out []byte
+	for len(msg) > 0 {
+		n := min(len(msg), size)
+		out = append(out, recordTypeHandshake, 3, 1, byte(n>>8), byte(n))
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+func sniExtension(name string) testExtension {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(name)) })
+	})
+	return testExtension{extensionServerName, b.BytesOrPanic()}
+}
+
+func alpnExtension(protos ...string) testExtension {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, p := range protos {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(p)) })
+		}
+	})
+	return testExtension{extensionALPN, b.BytesOrPanic()}
+}
+
+// Extension with a 16-bit length prefixed list of 16-bit values
+func uint16ListExtension(typ uint16, list ...uint16) testExtension {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, v := range list {
+			b.AddUint16(v)
+		}
+	})
+	return testExtension{typ, b.BytesOrPanic()}
+}
+
+func versionsExtension(versions ...uint16) testExtension {
+	var b cryptobyte.Builder
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, v := range versions {
+			b.AddUint16(v)
+		}
+	})
+	return testExtension{extensionVersions, b.BytesOrPanic()}
+}
+
+func pointFormatsExtension(formats ...uint8) testExtension {
+	return testExtension{extensionPointFormats, append([]byte{byte(len(formats))}, formats...)}
+}
+
+// Capture the ClientHello of crypto/tls
+func captureHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+	_, peeked, err := peekClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peeked
+}
+
+func TestPeekClientHello(t *testing.T) {
+	peeked := captureHello(t, &tls.Config{ServerName: "vpn1.myazure.net", NextProtos: []string{"h2", "http/1.1"}})
+
+	// Split across records
+	body := peeked[9:]
+	for _, size := range []int{len(body) + 4, 100, 1} {
+		client, server := net.Pipe()
+		records := helloRecords(body, size)
+		go func() {
+			client.Write(append(append([]byte{}, records...), "data"...))
+			client.Close()
+		}()
+		hello, got, err := peekClientHello(server)
+		if err != nil {
+			t.Fatalf("records of %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(got, records) {
+			t.Errorf("records of %d bytes: peeked %d bytes, want %d", size, len(got), len(records))
+		}
+		if hello.serverName != "vpn1.myazure.net" {
+			t.Errorf("server name %q", hello.serverName)
+		}
+		if len(hello.alpn) != 2 || hello.alpn[0] != "h2" || hello.alpn[1] != "http/1.1" {
+			t.Errorf("ALPN %q", hello.alpn)
+		}
+		if hello.ja3 == "" || hello.ja4[:4] != "t13d" {
+			t.Errorf("fingerprints %s %s", hello.ja3, hello.ja4)
+		}
+		server.Close()
+	}
+}
+
+func TestPeekClientHelloInvalid(t *testing.T) {
+	body := buildHello(tls.VersionTLS12, []uint16{tls.TLS_AES_128_GCM_SHA256}, nil)
+	tests := []struct {
+		name    string
+		data    []byte
+		invalid bool // errInvalidHello rather than a read error
+	}{
+		{name: "HTTP", data: []byte("GET / HTTP/1.1\r\n\r\n"), invalid: true},
+		{name: "empty record", data: []byte{recordTypeHandshake, 3, 1, 0, 0}, invalid: true},
+		{name: "oversize record", data: []byte{recordTypeHandshake, 3, 1, 0x40, 0x01}, invalid: true},
+		{name: "not a ClientHello", data: []byte{recordTypeHandshake, 3, 1, 0, 4, 2, 0, 0, 0}, invalid: true},
+		{name: "oversize ClientHello", data: []byte{recordTypeHandshake, 3, 1, 0, 4, handshakeClientHello, 0x01, 0x00, 0x01}, invalid: true},
+		{name: "invalid body", data: helloRecords(body[:40], 1000), invalid: true},
+		{name: "truncated record", data: helloRecords(body, 1000)[:20]},
+		{name: "truncated message", data: helloRecords(body, 20)[:25]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(tt.data)
+				client.Close()
+			}()
+			_, _, err := peekClientHello(server)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if errors.Is(err, errInvalidHello) != tt.invalid {
+				t.Errorf("error %q, invalid ClientHello %t", err, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestParseClientHelloNoExtensions(t *testing.T) {
+	hello, ok := parseClientHello(buildHello(tls.VersionTLS12, []uint16{tls.TLS_RSA_WITH_AES_128_GCM_SHA256}, nil))
+	if !ok {
+		t.Fatal("failed to parse")
+	}
+	if len(hello.extensions) != 0 || hello.serverName != "" {
+		t.Errorf("extensions %v, server name %q", hello.extensions, hello.serverName)
+	}
+	if got := hello.fingerprintJA4(); got != "t12i010000_dc2b145ead28_000000000000" {
+		t.Errorf("JA4 %s", got)
+	}
+}
+
+func TestParseClientHelloTruncated(t *testing.T) {
+	body := buildHello(tls.VersionTLS12, []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384}, []testExtension{
+		sniExtension("vpn1.myazure.net"),
+		uint16ListExtension(extensionGroups, 29, 23),
+		pointFormatsExtension(0),
+		uint16ListExtension(extensionSignatureAlgs, 0x0403, 0x0804),
+		alpnExtension("h2"),
+		versionsExtension(tls.VersionTLS13),
+	})
+	if _, ok := parseClientHello(body); !ok {
+		t.Fatal("failed to parse")
+	}
+
+	// Only the end of the compression methods is a valid end without extensions
+	noExtensions := 2 + 32 + 1 + 2 + 4 + 1 + 1
+	for n := range len(body) {
+		if _, ok := parseClientHello(body[:n]); ok && n != noExtensions {
+			t.Errorf("parsed hello truncated to %d of %d bytes", n, len(body))
+		}
+	}
+	if _, ok := parseClientHello(append(body, 0)); ok {
+		t.Error("parsed hello with trailing data")
+	}
+}
+
+func TestParseClientHelloMalformed(t *testing.T) {
+	tests := []struct {
+		name      string
+		extension testExtension
+	}{
+		{name: "SNI list past extension", extension: testExtension{extensionServerName, []byte{0, 10, 0, 0, 1, 'a'}}},
+		{name: "SNI name past list", extension: testExtension{extensionServerName, []byte{0, 4, 0, 0, 9, 'a'}}},
+		{name: "odd groups", extension: testExtension{extensionGroups, []byte{0, 3, 0, 29, 0}}},
+		{name: "point formats past extension", extension: testExtension{extensionPointFormats, []byte{5, 0}}},
+		{name: "odd signature algorithms", extension: testExtension{extensionSignatureAlgs, []byte{0, 1, 4}}},
+		{name: "ALPN protocol past list", extension: testExtension{extensionALPN, []byte{0, 3, 5, 'h', '2'}}},
+		{name: "odd versions", extension: testExtension{extensionVersions, []byte{3, 3, 4, 3}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := buildHello(tls.VersionTLS12, []uint16{tls.TLS_AES_128_GCM_SHA256}, []testExtension{tt.extension})
+			if _, ok := parseClientHello(body); ok {
+				t.Error("parsed malformed extension")
+			}
+		})
+	}
+
+	// Extension length past the extensions block
+	body := buildHello(tls.VersionTLS12, []uint16{tls.TLS_AES_128_GCM_SHA256}, []testExtension{{0x0017, nil}})
+	body[len(body)-1] = 1
+	if _, ok := parseClientHello(body); ok {
+		t.Error("parsed extension past the extensions block")
+	}
+	// Odd cipher suites
+	body = buildHello(tls.VersionTLS12, []uint16{tls.TLS_AES_128_GCM_SHA256}, nil)
+	if _, ok := parseClientHello(append(body[:35], 0, 1, 0x13, 1, 0)); ok {
+		t.Error("parsed odd cipher suites")
+	}
+}
@@ -0,0 +1,284 @@
+// History of control, relay and refused client sessions
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	historyFlushInterval = 10 * time.Second
+	historyPruneInterval = time.Hour
+	maxUnsavedHistory    = 100000 // records kept in memory while the database is unavailable
+	defaultHistoryLimit  = 1000
+)
+
+// Types of session records
+const (
+	historyControl = "control" // server control session
+	historyRelay   = "relay"   // relayed client
+	historyClient  = "client"  // client refused or not answered by the server
+)
+
+var historyBucket = []byte("sessions")
+
+var errHistoryDisabled = errors.New("session history is disabled")
+
+// Record of a finished session
+type sessionRecord struct {
+	Type        string    `json:"type"`
+	Session     uint64    `json:"session"`          // control, server data or client session number
+	Client      uint64    `json:"client,omitempty"` // client session number of a relay
+	Hostname    string    `json:"hostname"`
+	Suffix      string    `json:"suffix,omitempty"`
+	ServerIP    string    `json:"server_ip,omitempty"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	Auth        string    `json:"auth,omitempty"` // authentication method of a control session
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	ClientBytes int64     `json:"client_bytes,omitempty"` // relayed from client to server
+	ServerBytes int64     `json:"server_bytes,omitempty"` // relayed from server to client
+	Reason      string    `json:"reason"`                 // why the session closed
+}
+
+// Session records saved to a bbolt database by end time
+type historyStore struct {
+	mu      sync.Mutex
+	file    string
+	unsaved []sessionRecord
+	pruned  time.Time
+}
+
+// Create the database and start saving periodically if a file is given
+func (hs *historyStore) open(file string) error {
+	hs.file = file
+	if file == "" {
+		return nil
+	}
+	err := updateBucket(file, historyBucket, func(b *bolt.Bucket) error { return nil })
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(historyFlushInterval) {
+			if err := hs.flush(); err != nil {
+				lg.Event(slog.LevelError, "history.save_failed", fmt.Sprintf("history: error saving %s: %s", hs.file, err), "file", hs.file, "error", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// Record a finished session
+func (hs *historyStore) add(rec sessionRecord) {
+	if hs.file == "" {
+		return
+	}
+	rec.End = time.Now()
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if len(hs.unsaved) < maxUnsavedHistory {
+		hs.unsaved = append(hs.unsaved, rec)
+	}
+}
+
+// Record a server control session
+func (hs *historyStore) control(num uint64, conn net.Conn, hostname string, suffix string, auth authType, start time.Time, reason string) {
+	hs.add(sessionRecord{Type: historyControl, Session: num, Hostname: hostname, Suffix: suffix,
+		ServerIP: ipString(conn.RemoteAddr()), Auth: string(auth), Start: start, Reason: reason})
+}
+
+// Record a relay of a client
+func (hs *historyStore) relay(num uint64, cnum uint64, c pendingSession, conn net.Conn, start time.Time, st relayStats) {
+	hs.add(sessionRecord{Type: historyRelay, Session: num, Client: cnum, Hostname: c.hostname, Suffix: c.suffix,
+		ServerIP: ipString(conn.RemoteAddr()), ClientIP: ipString(c.conn.RemoteAddr()),
+		Start: start, ClientBytes: st.up, ServerBytes: st.down, Reason: st.reason})
+}
+
+// Record a client that was not relayed
+func (hs *historyStore) client(num uint64, conn net.Conn, hostname string, suffix string, start time.Time, reason string) {
+	hs.add(sessionRecord{Type: historyClient, Session: num, Hostname: hostname, Suffix: suffix,
+		ClientIP: ipString(conn.RemoteAddr()), Start: start, Reason: reason})
+}
+
+// Save unsaved records and remove records older than retention
+func (hs *historyStore) flush() error {
+	if hs.file == "" {
+		return nil
+	}
+	// Take unsaved records so that recording does not wait for the database
+	hs.mu.Lock()
+	now := time.Now()
+	prune := *historyRetention > 0 && now.Sub(hs.pruned) >= historyPruneInterval
+	unsaved := hs.unsaved
+	hs.unsaved = nil
+	hs.mu.Unlock()
+	if len(unsaved) == 0 && !prune {
+		return nil
+	}
+
+	err := updateBucket(hs.file, historyBucket, func(b *bolt.Bucket) error {
+		for _, rec := range unsaved {
+			v, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			// Sequence keeps keys unique if another process shares the database
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(historyKey(rec.End, seq), v); err != nil {
+				return err
+			}
+		}
+		if !prune {
+			return nil
+		}
+
+		// Keys are ordered by end time
+		var expired [][]byte
+		end := historyKey(now.Add(-*historyRetention), 0)
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(end); k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if err != nil {
+		// Keep records for the next try in order
+		hs.unsaved = append(unsaved, hs.unsaved...)
+		hs.unsaved = hs.unsaved[:min(len(hs.unsaved), maxUnsavedHistory)]
+		return err
+	}
+	if prune {
+		hs.pruned = now
+	}
+	return nil
+}
+
+// Key of a record, ordered by end time
+func historyKey(end time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(end.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+// Filter of session records
+type historyQuery struct {
+	hostname string
+	ip       netip.Addr
+	typ      string
+	from, to time.Time // sessions active within
+	limit    int
+}
+
+// Parse a query from form values host, ip, type, from, to and limit
+func parseHistoryQuery(get func(string) string) (historyQuery, error) {
+	q := historyQuery{hostname: strings.ToLower(get("host")), typ: get("type"), limit: defaultHistoryLimit}
+	var err error
+	if v := get("ip"); v != "" {
+		if q.ip, err = netip.ParseAddr(v); err != nil {
+			return q, err
+		}
+		q.ip = q.ip.Unmap()
+	}
+	switch q.typ {
+	case "", historyControl, historyRelay, historyClient:
+	default:
+		return q, fmt.Errorf("unknown type %s", q.typ)
+	}
+	if v := get("from"); v != "" {
+		if q.from, err = parseTime(v); err != nil {
+			return q, err
+		}
+	}
+	if v := get("to"); v != "" {
+		if q.to, err = parseTime(v); err != nil {
+			return q, err
+		}
+	}
+	if v := get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit <= 0 {
+			return q, fmt.Errorf("invalid limit %s", v)
+		}
+	}
+	return q, nil
+}
+
+// Parse RFC 3339 time or local time with optional seconds, or a date
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s", v)
+}
+
+// Check whether a record matches the filter
+func (q historyQuery) match(rec sessionRecord) bool {
+	if q.hostname != "" && rec.Hostname != q.hostname {
+		return false
+	}
+	if q.typ != "" && rec.Type != q.typ {
+		return false
+	}
+	if q.ip.IsValid() && rec.ClientIP != q.ip.String() && rec.ServerIP != q.ip.String() {
+		return false
+	}
+	return q.to.IsZero() || !rec.Start.After(q.to)
+}
+
+// Find records of sessions active within the time range, latest ended first
+func (hs *historyStore) query(q historyQuery) ([]sessionRecord, error) {
+	if hs.file == "" {
+		return nil, errHistoryDisabled
+	}
+	if err := hs.flush(); err != nil {
+		return nil, err
+	}
+	list := []sessionRecord{}
+	err := viewBucket(hs.file, historyBucket, func(b *bolt.Bucket) error {
+		// Sessions that ended before the range are all before it
+		from := string(historyKey(q.from, 0))
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(list) < q.limit; k, v = c.Prev() {
+			if !q.from.IsZero() && string(k) < from {
+				break
+			}
+			var rec sessionRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if q.match(rec) {
+				list = append(list, rec)
+			}
+		}
+		return nil
+	})
+	return list, err
+}
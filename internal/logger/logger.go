@@ -7,17 +7,40 @@
 package logger
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"sync"
 )
 
+// Names of session types in JSON
+var sessionTypes = map[byte]string{
+	'C': "client",
+	'L': "control",
+	'S': "data",
+	'P': "passthrough",
+}
+
 type Logger struct {
 	logger *log.Logger
+	slog   *slog.Logger // JSON lines if set
+	json   bool
+	level  slog.Level
 	file   *os.File
 	rw     sync.RWMutex
 }
 
+// Set output format and minimum level, applied by Open
+func (l *Logger) SetFormat(json bool, level slog.Level) {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	l.json = json
+	l.level = level
+}
+
 func (l *Logger) Open(filename string, append bool) {
 	l.rw.Lock()
 	defer l.rw.Unlock()
@@ -25,6 +48,7 @@ func (l *Logger) Open(filename string, append bool) {
 	if l.file != nil {
 		l.file.Close()
 	}
+	var w io.Writer = os.Stdout
 	if filename != "" {
 		var err error
 		if append {
@@ -35,9 +59,12 @@ func (l *Logger) Open(filename string, append bool) {
 		if err != nil {
 			log.Fatalf("Failed to create log file. Error: %s", err)
 		}
-		l.logger = log.New(l.file, "", log.Ldate|log.Ltime|log.Lmicroseconds)
-	} else {
-		l.logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+		w = l.file
+	}
+	l.logger = log.New(w, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+	l.slog = nil
+	if l.json {
+		l.slog = slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l.level}))
 	}
 }
 
@@ -49,32 +76,112 @@ func (l *Logger) Close() {
 
 func (l *Logger) Printf(format string, v ...any) {
 	l.rw.RLock()
-	l.logger.Printf(format, v...)
+	if l.slog != nil {
+		l.slog.Info(fmt.Sprintf(format, v...), "event", "log")
+	} else if l.level <= slog.LevelInfo {
+		l.logger.Printf(format, v...)
+	}
 	l.rw.RUnlock()
 }
 
 func (l *Logger) Print(v ...any) {
 	l.rw.RLock()
-	l.logger.Print(v...)
+	if l.slog != nil {
+		l.slog.Info(fmt.Sprint(v...), "event", "log")
+	} else if l.level <= slog.LevelInfo {
+		l.logger.Print(v...)
+	}
 	l.rw.RUnlock()
 }
 
 func (l *Logger) Println(v ...any) {
 	l.rw.RLock()
-	l.logger.Println(v...)
+	if l.slog != nil {
+		msg := fmt.Sprintln(v...)
+		l.slog.Info(msg[:len(msg)-1], "event", "log")
+	} else if l.level <= slog.LevelInfo {
+		l.logger.Println(v...)
+	}
 	l.rw.RUnlock()
 }
 
-// Print fancier log for sessions.
+// Print a node event with a level and attributes as key-value pairs.
+// Attributes are only shown in JSON.
+func (l *Logger) Event(level slog.Level, event string, msg string, args ...any) {
+	l.rw.RLock()
+	if l.slog != nil {
+		l.slog.Log(context.Background(), level, msg, append([]any{"event", event}, args...)...)
+	} else if level >= l.level {
+		l.logger.Print(msg)
+	}
+	l.rw.RUnlock()
+}
+
+// Log of a session with attributes shared by its events
+type Session struct {
+	l     *Logger
+	num   uint64
+	sType byte
+	attrs []any // key-value pairs
+}
+
+// Start a log of a session with attributes as key-value pairs
+func (l *Logger) Session(num uint64, sType byte, args ...any) Session {
+	return Session{l: l, num: num, sType: sType, attrs: args}
+}
+
+// Add attributes as key-value pairs
+func (s Session) With(args ...any) Session {
+	s.attrs = append(s.attrs[:len(s.attrs):len(s.attrs)], args...)
+	return s
+}
+
+// Change the session type once known
+func (s Session) As(sType byte) Session {
+	s.sType = sType
+	return s
+}
+
+// Print a session event.
 // Stage: 1 for starting, 2 for established, 3 for closing.
-func (l *Logger) PrintSessionf(format string, num uint64, sType byte, stage int, v ...any) {
+// In text, session type and number lead the message with the stage as a column.
+// In JSON, they are attributes along with the event name and the session attributes.
+func (s Session) Log(level slog.Level, event string, stage int, format string, v ...any) {
+	l := s.l
 	l.rw.RLock()
+	defer l.rw.RUnlock()
+	if l.slog != nil {
+		args := append([]any{"event", event, "session", s.num}, s.attrs...)
+		if name, ok := sessionTypes[s.sType]; ok {
+			args = append(args, "type", name)
+		}
+		l.slog.Log(context.Background(), level, fmt.Sprintf(format, v...), args...)
+		return
+	}
+	if level < l.level {
+		return
+	}
 	stages := [4]string{
 		"       ",
 		" *     ",
 		"   *   ",
 		"     * ",
 	}
-	l.logger.Printf("%c %5d:"+stages[stage]+format, append([]any{sType, num}, v...)...)
-	l.rw.RUnlock()
+	l.logger.Printf("%c %5d:"+stages[stage]+format, append([]any{s.sType, s.num}, v...)...)
+}
+
+func (s Session) Debug(event string, stage int, format string, v ...any) {
+	s.Log(slog.LevelDebug, event, stage, format, v...)
+}
+
+func (s Session) Info(event string, stage int, format string, v ...any) {
+	s.Log(slog.LevelInfo, event, stage, format, v...)
+}
+
+func (s Session) Warn(event string, stage int, format string, v ...any) {
+	s.Log(slog.LevelWarn, event, stage, format, v...)
+}
+
+func (s Session) Error(event string, stage int, format string, v ...any) {
+	s.Log(slog.LevelError, event, stage, format, v...)
 }
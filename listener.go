@@ -0,0 +1,365 @@
+// Accepting and dispatching connections
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type listenerRole string
+type listenerMode string
+
+const (
+	modeTLS     listenerMode = "TLS"
+	modeOffload listenerMode = "offloaded TLS" // plaintext from a proxy that terminates TLS
+	modeConnect listenerMode = "HTTP CONNECT"  // TLS tunneled through HTTP proxies
+
+	roleAll    listenerRole = "all"    // VPN clients and servers
+	roleClient listenerRole = "client" // VPN clients only
+	roleServer listenerRole = "server" // VPN servers (azure clients) only
+
+	proxyTLVAuthority = 0x02 // PROXY v2 TLV carrying the original SNI
+)
+
+// connection counter
+var connNum atomic.Uint64
+
+// Listening address with its settings
+type listener struct {
+	name     string
+	addr     string
+	mode     listenerMode
+	role     listenerRole     // roles served on this listener
+	suffixes []string         // suffixes served on this listener, empty for all
+	host     string           // hostname for clients without SNI
+	cert     *tls.Certificate // certificate for clients without SNI, suffix certificate if nil
+	metrics  *expvar.Map
+}
+
+// Listener flag that can be repeated
+type listenerFlag struct {
+	mode listenerMode
+	list []*listener
+}
+
+// Define a listener flag
+func listenerFlags(name string, mode listenerMode, usage string) *listenerFlag {
+	f := &listenerFlag{mode: mode}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *listenerFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var addrs []string
+	for _, l := range f.list {
+		addrs = append(addrs, l.addr)
+	}
+	return strings.Join(addrs, " ")
+}
+
+// Parse address[,option=value...]
+func (f *listenerFlag) Set(s string) error {
+	var certFile, keyFile string
+	fields := strings.Split(s, ",")
+	l := &listener{name: fields[0], addr: fields[0], mode: f.mode, role: roleAll}
+	if f.mode == modeConnect {
+		// VPN servers don't need proxies as they dial out anyway
+		l.role = roleClient
+	}
+	for _, field := range fields[1:] {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid listener option %s", field)
+		}
+		switch strings.ToLower(k) {
+		case "name":
+			l.name = v
+		case "role":
+			switch r := listenerRole(strings.ToLower(v)); r {
+			case roleAll, roleClient, roleServer:
+				l.role = r
+			default:
+				return fmt.Errorf("invalid listener role %s", v)
+			}
+		case "suffix":
+			if !strings.HasPrefix(v, ".") {
+				return fmt.Errorf("invalid listener suffix %s", v)
+			}
+			l.suffixes = append(l.suffixes, strings.ToLower(v))
+		case "host":
+			l.host = strings.ToLower(v)
+		case "cert":
+			certFile = v
+		case "key":
+			keyFile = v
+		default:
+			return fmt.Errorf("unknown listener option %s", k)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if l.host == "" {
+			return errors.New("listener certificate is only used with host")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		l.cert = &cert
+	}
+	f.list = append(f.list, l)
+	return nil
+}
+
+// Describe settings for logging
+func (l *listener) String() string {
+	s := fmt.Sprintf("%s (%s, role %s", l.addr, l.mode, l.role)
+	if len(l.suffixes) > 0 {
+		s += ", suffixes " + strings.Join(l.suffixes, " ")
+	}
+	if l.host != "" {
+		s += ", mapped to " + l.host
+	}
+	return s + ")"
+}
+
+// Check whether a role and suffix are served on this listener
+func (l *listener) allow(server bool, suffix string) error {
+	if server && l.role == roleClient {
+		return errors.New("servers are not accepted on this listener")
+	}
+	if !server && l.role == roleServer {
+		return errors.New("clients are not accepted on this listener")
+	}
+	if len(l.suffixes) == 0 {
+		return nil
+	}
+	for _, s := range l.suffixes {
+		if s == suffix {
+			return nil
+		}
+	}
+	return fmt.Errorf("suffix %s is not served on this listener", suffix)
+}
+
+// Accept connections
+func (l *listener) serve(nl net.Listener) {
+	lg.Printf("Listening on %s", l)
+	l.metrics = new(expvar.Map).Init()
+	metricListeners.Set(l.name, l.metrics)
+	config := &tls.Config{GetConfigForClient: l.getConfigForClient}
+	for {
+		conn, err := nl.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			lg.Printf("Stopped listening on %s", l)
+			return
+		}
+		if err != nil {
+			lg.Event(slog.LevelError, "listener.error", fmt.Sprintf("Failed to accept on %s: %s", l, err), "listener", l.name, "error", err.Error())
+			continue
+		}
+		l.metrics.Add("accepted", 1)
+		if blocks.contains(addrIP(conn.RemoteAddr())) {
+			metricUnknownSNI.Add("blocked", 1)
+			conn.Close()
+			continue
+		}
+		if err := preauth.enter(); err != nil {
+			metricPreauthDropped.Add(err.Error(), 1)
+			conn.Close()
+			continue
+		}
+		go l.handleConn(connNum.Add(1), conn, config)
+	}
+}
+
+// Handle a new connection.
+// conn automatically closes on return.
+func (l *listener) handleConn(num uint64, conn net.Conn, config *tls.Config) {
+	defer conn.Close()
+
+	// Slot taken in serve is released once authenticated
+	var source netip.Addr
+	left := false
+	leave := func() {
+		if !left {
+			left = true
+			preauth.leave(source)
+		}
+	}
+	defer leave()
+
+	// Get original addresses from load balancer
+	var pc *proxyConn
+	if trustedProxy(conn.RemoteAddr()) {
+		conn.SetDeadline(time.Now().Add(proxyHeaderTimeout))
+		var err error
+		pc, err = readProxyHeader(conn)
+		if err != nil {
+			l.metrics.Add("invalid", 1)
+			lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Warn("connection.invalid", 0, "Invalid PROXY protocol header from %s on %s: %s", conn.RemoteAddr(), l.name, err)
+			return
+		}
+		if pc.health {
+			// Neither a client nor an offense, so only counted by the listener
+			l.metrics.Add("health_check", 1)
+			return
+		}
+		conn = pc
+		if blocks.contains(addrIP(conn.RemoteAddr())) {
+			metricUnknownSNI.Add("blocked", 1)
+			return
+		}
+	}
+
+	// Dropped silently as logs would be flooded
+	if err := preauth.enterSource(addrIP(conn.RemoteAddr())); err != nil {
+		metricPreauthDropped.Add(err.Error(), 1)
+		return
+	}
+	source = addrIP(conn.RemoteAddr())
+
+	// Limit time of all steps before authentication
+	conn.SetDeadline(time.Now().Add(*handshakeTimeout))
+
+	// Open tunnel requested by HTTP proxy clients
+	var connectHost string
+	if l.mode == modeConnect {
+		tunnel, host, err := acceptConnect(conn)
+		if errors.Is(err, errConnectRefused) {
+			blocks.offend(source)
+			l.metrics.Add("refused", 1)
+			lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Warn("connection.refused", 0, "CONNECT from %s refused on %s: %s", conn.RemoteAddr(), l.name, err)
+			return
+		} else if err != nil {
+			l.metrics.Add("invalid", 1)
+			lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Warn("connection.invalid", 0, "Invalid CONNECT request from %s on %s: %s", conn.RemoteAddr(), l.name, err)
+			return
+		}
+		conn = tunnel
+		connectHost = host
+	}
+
+	// Sort out unknown SNIs before TLS handshake.
+	// Scanners are logged at debug level as they would flood logs.
+	if l.mode != modeOffload {
+		hello, peeked, err := peekClientHello(conn)
+		if errors.Is(err, errInvalidHello) {
+			// Only protocol violations count as offenses, slow or lossy clients may time out
+			blocks.offend(source)
+			l.metrics.Add("invalid", 1)
+			lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Debug("connection.invalid", 0, "Invalid ClientHello from %s on %s: %s", conn.RemoteAddr(), l.name, err)
+			return
+		} else if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				l.metrics.Add("handshake_timeout", 1)
+			} else {
+				l.metrics.Add("handshake_failed", 1)
+			}
+			lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Info("connection.hello_failed", 0, "Failed to read ClientHello from %s on %s: %s", conn.RemoteAddr(), l.name, err)
+			return
+		}
+		pconn := newPeekedConn(conn, peeked)
+		pconn.hello = hello
+		conn = pconn
+		if !fingerprintDeny.permit(hello) {
+			blocks.offend(source)
+			l.metrics.Add("fingerprint_denied", 1)
+			return
+		}
+		if _, _, _, ok := suffixes.parse(hello.serverName); l.mode == modeTLS && !ok && (hello.serverName != "" || l.host == "") {
+			// Forward TLS connections for other sites on the same port
+			if route, ok := passthroughs.find(hello.serverName); ok {
+				l.metrics.Add("passthrough", 1)
+				conn.SetDeadline(time.Time{})
+				leave()
+				handlePassthrough(num, conn, hello.serverName, route)
+				return
+			}
+			blocks.offend(source)
+			l.metrics.Add("unknown_sni", 1)
+			handleUnknown(conn, leave)
+			return
+		}
+	}
+
+	var serverName string
+	if l.mode == modeOffload {
+		// SNI is forwarded by the offloading proxy
+		if pc == nil {
+			l.metrics.Add("invalid", 1)
+			lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Warn("connection.untrusted", 0, "Plaintext connection from untrusted %s on %s", conn.RemoteAddr(), l.name)
+			return
+		}
+		serverName = string(pc.tlvs[proxyTLVAuthority])
+	} else {
+		tlsConn := tls.Server(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				l.metrics.Add("handshake_timeout", 1)
+			} else {
+				l.metrics.Add("handshake_failed", 1)
+			}
+			lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Warn("connection.handshake_failed", 0, "TLS handshake failed on %s: %s", l.name, err)
+			return
+		}
+		serverName = tlsConn.ConnectionState().ServerName
+		conn = tlsConn
+	}
+
+	// Route clients without SNI by listener
+	if serverName == "" {
+		serverName = l.host
+	}
+	if serverName == "" {
+		blocks.offend(source)
+		l.metrics.Add("invalid", 1)
+		lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Warn("connection.invalid", 0, "SNI is empty on %s", l.name)
+		return
+	}
+	if connectHost != "" && !strings.EqualFold(serverName, connectHost) {
+		l.metrics.Add("invalid", 1)
+		lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Warn("connection.invalid", 0, "SNI %s does not match CONNECT target %s on %s", serverName, connectHost, l.name)
+		return
+	}
+	hostname, suffix, server, ok := suffixes.parse(serverName)
+	if ok && !server && isRelayHost(hostname) {
+		// Data sessions steered to this node by relay address
+		server = true
+	}
+	if !ok {
+		blocks.offend(source)
+		l.metrics.Add("invalid", 1)
+		lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Warn("connection.invalid", 0, "SNI %s does not match any suffix on %s", serverName, l.name)
+		return
+	}
+	if err := l.allow(server, suffix.suffix); err != nil {
+		l.metrics.Add("refused", 1)
+		lg.Session(num, ' ', "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name).Warn("connection.refused", 0, "Connection from %s refused: %s", conn.RemoteAddr(), err)
+		return
+	}
+	// Servers authenticate with their own deadline and leave once done,
+	// clients are authorized by sessions
+	conn.SetDeadline(time.Time{})
+	if server {
+		l.metrics.Add("server", 1)
+		handleServer(num, conn, suffix, l, leave)
+	} else {
+		leave()
+		l.metrics.Add("client", 1)
+		handleClient(num, conn, hostname, suffix.suffix, l)
+	}
+}
@@ -0,0 +1,35 @@
+// Runtime metrics
+
+package main
+
+import (
+	"expvar"
+)
+
+var (
+	metricFlaps          = expvar.NewMap("flap_events")     // flapping events per hostname
+	metricRelayBytes     = expvar.NewMap("relay_bytes")     // relayed bytes per direction
+	metricQuotaExceeded  = expvar.NewMap("quota_exceeded")  // exceeded quotas per counter
+	metricClientRejected = expvar.NewMap("client_rejected") // refused clients per reason
+	metricAuthFailures   = expvar.NewMap("auth_failures")   // failed server registrations per reason
+	metricSourceDenied   = expvar.NewMap("source_denied")   // server registrations refused by source address per hostname
+	metricPassthrough    = expvar.NewMap("passthrough")     // forwarded connections per backend
+	metricListeners      = expvar.NewMap("listeners")       // connection counters per listener
+	metricPreauthDropped = expvar.NewMap("preauth_dropped") // connections dropped before authentication per reason
+	metricUnknownSNI     = expvar.NewMap("unknown_sni")     // connections with unknown SNI per action
+)
+
+func init() {
+	// Hostnames currently considered flapping
+	expvar.Publish("flapping", expvar.Func(func() any {
+		return sessions.flappingHosts()
+	}))
+	// Connections not yet authenticated
+	expvar.Publish("preauth", expvar.Func(func() any {
+		return preauth.count()
+	}))
+	// Temporarily blocked addresses
+	expvar.Publish("blocked", expvar.Func(func() any {
+		return blocks.list()
+	}))
+}
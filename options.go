@@ -0,0 +1,124 @@
+// Optional settings in config files and flags
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Optional key=value fields that follow the required fields of a config line
+type options map[string]string
+
+// Parse optional fields.
+// Empty fields are skipped and a field starting with / or # ends the line as comment.
+// Fields without a value are returned as ignored.
+func parseOptions(fields []string) (o options, ignored []string) {
+	o = options{}
+	for _, f := range fields {
+		if f == "" {
+			continue
+		}
+		if strings.HasPrefix(f, "/") || strings.HasPrefix(f, "#") {
+			break
+		}
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			ignored = append(ignored, f)
+			continue
+		}
+		o[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+	}
+	return o, ignored
+}
+
+// Get a size in bytes, 0 if not set
+func (o options) size(key string) (int64, error) {
+	v, ok := o[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %s", key, err)
+	}
+	return n, nil
+}
+
+// Get a non-negative integer, 0 if not set
+func (o options) int(key string) (int, error) {
+	v, ok := o[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("option %s: invalid number %s", key, v)
+	}
+	return n, nil
+}
+
+// Get a non-negative decimal, 0 if not set
+func (o options) float(key string) (float64, error) {
+	v, ok := o[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("option %s: invalid number %s", key, v)
+	}
+	return n, nil
+}
+
+// Parse a size in bytes with optional K, M, G or T suffix (powers of 1024)
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	unit := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		case 'T':
+			unit = 1 << 40
+		}
+		if unit > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// Size flag accepting K, M, G or T suffix
+type sizeValue int64
+
+func (v *sizeValue) String() string {
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+func (v *sizeValue) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*v = sizeValue(n)
+	return nil
+}
+
+// Define a size flag
+func sizeFlag(name string, value int64, usage string) *int64 {
+	p := new(int64)
+	*p = value
+	flag.Var((*sizeValue)(p), name, usage)
+	return p
+}
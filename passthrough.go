@@ -0,0 +1,162 @@
+// Passing non-matching SNIs through to other backends
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backendDialTimeout = 10 * time.Second
+
+// Backend for SNIs matching a pattern
+type passthroughRoute struct {
+	pattern *regexp.Regexp
+	backend string // address and port
+	proxy   int    // PROXY protocol version sent to backend, 0 for none
+}
+
+// Passthrough list with mutex
+type passthroughList struct {
+	list []passthroughRoute
+	rw   sync.RWMutex
+}
+
+// Read or update passthrough list
+func (pl *passthroughList) read(file string) int {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	pl.rw.Lock()
+	defer pl.rw.Unlock()
+
+	pl.list = nil
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		// Format: SNI pattern[TAB]backend address[TAB]options...
+		line := strings.Split(scanner.Text(), "	")
+
+		if len(line) < 2 {
+			continue
+		}
+
+		if strings.HasPrefix(line[0], "/") || strings.HasPrefix(line[0], "#") {
+			continue
+		}
+
+		pattern, err := regexp.Compile(wildCardToRegexp(strings.ToLower(line[0])))
+		if err != nil {
+			continue
+		}
+
+		route := passthroughRoute{pattern: pattern, backend: line[1]}
+		opts, ignored := parseOptions(line[2:])
+		route.proxy, err = opts.int("proxy")
+		if err == nil && route.proxy > 2 {
+			err = fmt.Errorf("invalid PROXY protocol version %d", route.proxy)
+		}
+		if err != nil {
+			lg.Event(slog.LevelError, "passthrough.invalid", fmt.Sprintf("passthrough: error parsing options for pattern %s: %s", line[0], err), "pattern", line[0], "error", err.Error())
+			continue
+		}
+		for _, f := range ignored {
+			lg.Event(slog.LevelWarn, "passthrough.ignored", fmt.Sprintf("passthrough: ignoring field %s without value for pattern %s", f, line[0]), "pattern", line[0], "field", f)
+		}
+		pl.list = append(pl.list, route)
+	}
+
+	return len(pl.list)
+}
+
+// Check whether any route is configured
+func (pl *passthroughList) enabled() bool {
+	pl.rw.RLock()
+	defer pl.rw.RUnlock()
+	return len(pl.list) > 0
+}
+
+// Look up backend by SNI
+func (pl *passthroughList) find(sni string) (passthroughRoute, bool) {
+	pl.rw.RLock()
+	defer pl.rw.RUnlock()
+
+	serverName := strings.ToLower(sni)
+	for _, r := range pl.list {
+		if r.pattern.MatchString(serverName) {
+			return r, true
+		}
+	}
+	return passthroughRoute{}, false
+}
+
+// Forward a connection to backend without terminating TLS.
+// conn automatically closes on return, do not fork.
+func handlePassthrough(num uint64, conn net.Conn, sni string, route passthroughRoute) {
+	sess := lg.Session(num, 'P', "sni", sni, "remote_ip", ipString(conn.RemoteAddr()), "backend", route.backend)
+	sess.Info("passthrough.start", 1, "Passing SNI %s from %s through to %s", sni, conn.RemoteAddr(), route.backend)
+	backend, err := net.DialTimeout("tcp", route.backend, backendDialTimeout)
+	if err != nil {
+		sess.Warn("passthrough.error", 3, "Connection closed: %s", err)
+		return
+	}
+	defer backend.Close()
+	metricPassthrough.Add(route.backend, 1)
+
+	if route.proxy > 0 {
+		if _, err := backend.Write(proxyHeader(route.proxy, conn)); err != nil {
+			sess.Warn("passthrough.error", 3, "Connection closed: %s", err)
+			return
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	r := relay{client: conn, server: backend}
+	st := r.run()
+	sess.With("reason", st.reason, "client_bytes", st.up, "server_bytes", st.down).Info("passthrough.closed", 3, "Connection closed (%s): relayed %d bytes to backend and %d bytes from backend in %s",
+		st.reason, st.up, st.down, st.duration.Round(time.Second))
+}
+
+// Build PROXY protocol header describing a connection
+func proxyHeader(version int, conn net.Conn) []byte {
+	src, ok1 := conn.RemoteAddr().(*net.TCPAddr)
+	dst, ok2 := conn.LocalAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		if version == 1 {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		return append(append([]byte{}, proxyV2Signature...), 0x20, 0, 0, 0)
+	}
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if version == 1 {
+		family := "TCP6"
+		if src4 != nil && dst4 != nil {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port))
+	}
+	b := append([]byte{}, proxyV2Signature...)
+	if src4 != nil && dst4 != nil {
+		b = append(b, 0x21, 0x11, 0, 12)
+		b = append(b, src4...)
+		b = append(b, dst4...)
+	} else {
+		b = append(b, 0x21, 0x21, 0, 36)
+		b = append(b, src.IP.To16()...)
+		b = append(b, dst.IP.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+	b = binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+	return b
+}
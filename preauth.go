@@ -0,0 +1,107 @@
+// Limits of connections before authentication
+
+package main
+
+import (
+	"errors"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Reasons to drop a connection before authentication
+var (
+	errPreauthLimit = errors.New("too many unauthenticated connections")
+	errSourceLimit  = errors.New("too many unauthenticated connections from the address")
+	errSourceRate   = errors.New("too many new connections from the address")
+)
+
+// Unauthenticated connections of a source address
+type sourceLoad struct {
+	active  int
+	limiter *rate.Limiter
+}
+
+// Thread-safe counters of unauthenticated connections
+type preauthList struct {
+	mu      sync.Mutex
+	total   int
+	sources map[netip.Addr]*sourceLoad
+	pruned  time.Time
+}
+
+// Take a slot of the global limit when a connection is accepted
+func (pl *preauthList) enter() error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if *maxPreauth > 0 && pl.total >= *maxPreauth {
+		return errPreauthLimit
+	}
+	pl.total++
+	return nil
+}
+
+// Check limits of the original source address
+func (pl *preauthList) enterSource(ip netip.Addr) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.sources == nil {
+		pl.sources = make(map[netip.Addr]*sourceLoad)
+	}
+	s := pl.sources[ip]
+	if s == nil {
+		limit, burst := rate.Inf, 1
+		if *sourceConnRate > 0 {
+			limit, burst = rate.Limit(*sourceConnRate), max(int(math.Ceil(*sourceConnRate)), 1)
+		}
+		s = &sourceLoad{limiter: rate.NewLimiter(limit, burst)}
+		pl.sources[ip] = s
+	}
+	if *maxSourcePreauth > 0 && s.active >= *maxSourcePreauth {
+		return errSourceLimit
+	}
+	if !s.limiter.Allow() {
+		return errSourceRate
+	}
+	s.active++
+	return nil
+}
+
+// Release slots after authentication or disconnection.
+// ip is invalid if the source has not entered.
+func (pl *preauthList) leave(ip netip.Addr) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.total--
+	if s := pl.sources[ip]; s != nil && ip.IsValid() {
+		s.active--
+		if s.idle() {
+			delete(pl.sources, ip)
+		}
+	}
+
+	// Sources refused by rate are never left
+	if time.Since(pl.pruned) > time.Minute {
+		for ip, s := range pl.sources {
+			if s.idle() {
+				delete(pl.sources, ip)
+			}
+		}
+		pl.pruned = time.Now()
+	}
+}
+
+// Whether a source has no connection and its rate limit is fully restored
+func (s *sourceLoad) idle() bool {
+	return s.active == 0 && s.limiter.Tokens() >= float64(s.limiter.Burst())
+}
+
+// Number of unauthenticated connections
+func (pl *preauthList) count() int {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.total
+}
@@ -0,0 +1,174 @@
+// PROXY protocol v1/v2 from trusted load balancers
+//
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1MaxLength   = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Connection with original addresses from PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+	tlvs   map[byte][]byte // v2 type-length-values
+	health bool            // LOCAL or UNKNOWN connection of the proxy itself, e.g. a health check
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Shut down the writing side of the underlying connection
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
+
+// Check whether a connection comes from a trusted proxy
+func trustedProxy(addr net.Addr) bool {
+	return trustedProxyIP(addrIP(addr))
+}
+
+// Check whether an address is of a trusted proxy
+func trustedProxyIP(ip netip.Addr) bool {
+	for _, p := range proxyFrom {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read PROXY protocol header without consuming data after it.
+// Addresses are kept as is for LOCAL and UNKNOWN connections.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	pc := &proxyConn{Conn: conn, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+
+	// Both versions are longer than the v2 signature
+	b := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, proxyV2Signature) {
+		return pc, pc.readV2()
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return pc, pc.readV1(b)
+	}
+	return nil, errors.New("PROXY protocol header not found")
+}
+
+// Read the rest of a v1 header
+func (pc *proxyConn) readV1(b []byte) error {
+	// Read byte by byte to stop at the end of line
+	c := make([]byte, 1)
+	for !bytes.HasSuffix(b, []byte("\r\n")) {
+		if len(b) >= proxyV1MaxLength {
+			return errors.New("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(pc.Conn, c); err != nil {
+			return err
+		}
+		b = append(b, c[0])
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		pc.health = true
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errors.New("invalid PROXY v1 header")
+	}
+	src, err1 := netip.ParseAddr(fields[2])
+	dst, err2 := netip.ParseAddr(fields[3])
+	srcPort, err3 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err4 := strconv.ParseUint(fields[5], 10, 16)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return errors.New("invalid PROXY v1 header")
+	}
+	pc.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src.Unmap(), uint16(srcPort)))
+	pc.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst.Unmap(), uint16(dstPort)))
+	return nil
+}
+
+// Read the rest of a v2 header after signature
+func (pc *proxyConn) readV2() error {
+	h := make([]byte, 4)
+	if _, err := io.ReadFull(pc.Conn, h); err != nil {
+		return err
+	}
+	if h[0]>>4 != 2 {
+		return errors.New("unsupported PROXY protocol version")
+	}
+	b := make([]byte, binary.BigEndian.Uint16(h[2:]))
+	if _, err := io.ReadFull(pc.Conn, b); err != nil {
+		return err
+	}
+
+	// LOCAL command is sent by the proxy itself (e.g. health checks)
+	if h[0]&0xf == 0 {
+		pc.health = true
+		return nil
+	}
+	if h[0]&0xf != 1 {
+		return errors.New("unsupported PROXY v2 command")
+	}
+
+	var n int
+	switch h[1] {
+	case 0x11: // TCP over IPv4
+		n = 12
+		if len(b) < n {
+			return errors.New("invalid PROXY v2 header")
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(b[0:4]), Port: int(binary.BigEndian.Uint16(b[8:]))}
+		pc.local = &net.TCPAddr{IP: net.IP(b[4:8]), Port: int(binary.BigEndian.Uint16(b[10:]))}
+	case 0x21: // TCP over IPv6
+		n = 36
+		if len(b) < n {
+			return errors.New("invalid PROXY v2 header")
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(b[0:16]), Port: int(binary.BigEndian.Uint16(b[32:]))}
+		pc.local = &net.TCPAddr{IP: net.IP(b[16:32]), Port: int(binary.BigEndian.Uint16(b[34:]))}
+	default:
+		// Unspecified or unsupported family, TLVs may still follow but can't be located
+		return nil
+	}
+
+	// Parse TLVs
+	pc.tlvs = make(map[byte][]byte)
+	for b = b[n:]; len(b) >= 3; {
+		l := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < 3+l {
+			return errors.New("invalid PROXY v2 TLV")
+		}
+		pc.tlvs[b[0]] = b[3 : 3+l]
+		b = b[3+l:]
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Build a v2 header from command, family and the block after the length
+func proxyV2Header(command byte, family byte, block []byte) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, 0x20|command, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(block)))
+	return append(h, block...)
+}
+
+// Build a v2 TLV
+func proxyV2TLV(typ byte, value string) []byte {
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// Address block of 203.0.113.7:51000 to 192.0.2.1:443
+var proxyV2IPv4 = []byte{203, 0, 113, 7, 192, 0, 2, 1, 0xc7, 0x38, 0x01, 0xbb}
+
+// Address block of [2001:db8::7]:51000 to [2001:db8::1]:443
+var proxyV2IPv6 = []byte{
+	0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7,
+	0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+	0xc7, 0x38, 0x01, 0xbb,
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    []byte
+		remote    string // "pipe" when addresses are kept
+		local     string
+		authority string
+		health    bool
+		err       bool
+	}{
+		{name: "v1 TCP4", header: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 443\r\n"), remote: "203.0.113.7:51000", local: "192.0.2.1:443"},
+		{name: "v1 TCP6", header: []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 443\r\n"), remote: "[2001:db8::7]:51000", local: "[2001:db8::1]:443"},
+		{name: "v1 IPv4-mapped", header: []byte("PROXY TCP6 ::ffff:203.0.113.7 ::ffff:192.0.2.1 51000 443\r\n"), remote: "203.0.113.7:51000", local: "192.0.2.1:443"},
+		{name: "v1 UNKNOWN", header: []byte("PROXY UNKNOWN\r\n"), remote: "pipe", local: "pipe", health: true},
+		{name: "v1 UNKNOWN with addresses", header: []byte("PROXY UNKNOWN 203.0.113.7 192.0.2.1 51000 443\r\n"), remote: "pipe", local: "pipe", health: true},
+		{name: "v1 longest TCP6", header: []byte("PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"), remote: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", local: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"},
+		{name: "v1 107 bytes", header: []byte("PROXY UNKNOWN " + strings.Repeat("x", 91) + "\r\n"), remote: "pipe", local: "pipe", health: true},
+		{name: "v1 108 bytes", header: []byte("PROXY UNKNOWN " + strings.Repeat("x", 92) + "\r\n"), err: true},
+		{name: "v1 too long", header: []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), err: true},
+		{name: "v1 invalid protocol", header: []byte("PROXY UDP4 203.0.113.7 192.0.2.1 51000 443\r\n"), err: true},
+		{name: "v1 invalid port", header: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 65536 443\r\n"), err: true},
+		{name: "v1 missing fields", header: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000\r\n"), err: true},
+		{name: "v2 IPv4", header: proxyV2Header(1, 0x11, proxyV2IPv4), remote: "203.0.113.7:51000", local: "192.0.2.1:443"},
+		{name: "v2 IPv6", header: proxyV2Header(1, 0x21, proxyV2IPv6), remote: "[2001:db8::7]:51000", local: "[2001:db8::1]:443"},
+		{name: "v2 LOCAL", header: proxyV2Header(0, 0x00, nil), remote: "pipe", local: "pipe", health: true},
+		{name: "v2 LOCAL with addresses", header: proxyV2Header(0, 0x11, proxyV2IPv4), remote: "pipe", local: "pipe", health: true},
+		{name: "v2 unspecified family", header: proxyV2Header(1, 0x00, nil), remote: "pipe", local: "pipe"},
+		{name: "v2 authority", header: proxyV2Header(1, 0x11, append(append([]byte{}, proxyV2IPv4...), proxyV2TLV(proxyTLVAuthority, "vpn1.myazure.net")...)), remote: "203.0.113.7:51000", local: "192.0.2.1:443", authority: "vpn1.myazure.net"},
+		{name: "v2 authority after other TLV", header: proxyV2Header(1, 0x11, append(append(append([]byte{}, proxyV2IPv4...), proxyV2TLV(0x04, "")...), proxyV2TLV(proxyTLVAuthority, "vpn1.myazure.net")...)), remote: "203.0.113.7:51000", local: "192.0.2.1:443", authority: "vpn1.myazure.net"},
+		{name: "v2 truncated IPv4 addresses", header: proxyV2Header(1, 0x11, proxyV2IPv4[:8]), err: true},
+		{name: "v2 truncated IPv6 addresses", header: proxyV2Header(1, 0x21, proxyV2IPv6[:32]), err: true},
+		{name: "v2 TLV past header", header: proxyV2Header(1, 0x11, append(append([]byte{}, proxyV2IPv4...), proxyTLVAuthority, 0, 20, 'v', 'p', 'n')), err: true},
+		{name: "v2 invalid version", header: append(append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 12), proxyV2IPv4...), err: true},
+		{name: "v2 invalid command", header: proxyV2Header(2, 0x11, proxyV2IPv4), err: true},
+		{name: "no header", header: []byte("GET / HTTP/1.1\r\n\r\n"), err: true},
+		{name: "truncated signature", header: proxyV2Signature[:8], err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				// Data after the header must be left for the TLS handshake
+				client.Write(append(append([]byte{}, tt.header...), "data"...))
+				client.Close()
+			}()
+
+			pc, err := readProxyHeader(server)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got remote %s", pc.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pc.RemoteAddr().String(); got != tt.remote {
+				t.Errorf("remote address %s, want %s", got, tt.remote)
+			}
+			if got := pc.LocalAddr().String(); got != tt.local {
+				t.Errorf("local address %s, want %s", got, tt.local)
+			}
+			if got := string(pc.tlvs[proxyTLVAuthority]); got != tt.authority {
+				t.Errorf("authority %q, want %q", got, tt.authority)
+			}
+			if pc.health != tt.health {
+				t.Errorf("health check %t, want %t", pc.health, tt.health)
+			}
+			rest, err := io.ReadAll(pc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, []byte("data")) {
+				t.Errorf("data after header %q, want %q", rest, "data")
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// Monthly traffic quotas with persistent usage counters
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type quotaAction string
+
+const (
+	quotaCut      quotaAction = "cut"      // close relays and refuse new clients
+	quotaThrottle quotaAction = "throttle" // limit bandwidth to quota_rate
+	quotaWarn     quotaAction = "warn"     // log only
+
+	usageFlushInterval = time.Minute
+)
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// Relayed bytes in the current month, persisted in a JSON file
+type usageStore struct {
+	file   string
+	month  string           // current period (e.g. 2006-01)
+	counts map[string]int64 // bytes by counter key, including unsaved
+	delta  map[string]int64 // bytes not yet saved
+	warned map[string]bool  // counters reported as exceeded this month
+	mu     sync.Mutex
+}
+
+// Usage saved in file
+type usageData struct {
+	Month string           `json:"month"`
+	Usage map[string]int64 `json:"usage"`
+}
+
+// Quota applied to a relay session
+type quotaTracker struct {
+	hostKey   string
+	ruleKey   string
+	hostQuota int64
+	ruleQuota int64
+	action    quotaAction
+	rate      int64         // bandwidth once exceeded if throttling
+	limiter   *rate.Limiter // throttles the session once exceeded
+}
+
+// Counter keys
+func hostUsageKey(hostname string) string { return "host:" + hostname }
+func ruleUsageKey(rule string) string     { return "rule:" + rule }
+
+func currentMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// Load saved usage and start saving periodically if a file is given
+func (us *usageStore) open(file string) error {
+	us.file = file
+	us.month = currentMonth()
+	us.counts = make(map[string]int64)
+	us.delta = make(map[string]int64)
+	us.warned = make(map[string]bool)
+	if file == "" {
+		return nil
+	}
+	f, err := us.load()
+	if err != nil {
+		return err
+	}
+	if f.Month == us.month {
+		for k, v := range f.Usage {
+			us.counts[k] = v
+		}
+	}
+	go func() {
+		for range time.Tick(usageFlushInterval) {
+			if err := us.flush(); err != nil {
+				lg.Event(slog.LevelError, "usage.save_failed", fmt.Sprintf("usage: error saving %s: %s", us.file, err), "file", us.file, "error", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// Read usage file, a missing file is empty
+func (us *usageStore) load() (usageData, error) {
+	var f usageData
+	b, err := os.ReadFile(us.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return f, err
+	}
+	err = json.Unmarshal(b, &f)
+	return f, err
+}
+
+// Merge unsaved bytes into the file.
+// Reading before writing keeps counts added by another process sharing the file.
+func (us *usageStore) flush() error {
+	if us.file == "" {
+		return nil
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if len(us.delta) == 0 {
+		return nil
+	}
+	f, err := us.load()
+	if err != nil {
+		return err
+	}
+	if f.Month != us.month || f.Usage == nil {
+		f = usageData{Month: us.month, Usage: make(map[string]int64)}
+	}
+	for k, v := range us.delta {
+		f.Usage[k] += v
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(us.file), ".usage-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), us.file); err != nil {
+		return err
+	}
+	us.counts = f.Usage
+	us.delta = make(map[string]int64)
+	return nil
+}
+
+// Start a new month if needed.
+// Must be called with lock held.
+func (us *usageStore) rollover() {
+	if month := currentMonth(); month != us.month {
+		us.month = month
+		us.counts = make(map[string]int64)
+		us.delta = make(map[string]int64)
+		us.warned = make(map[string]bool)
+	}
+}
+
+// Add bytes to counters and return the new totals
+func (us *usageStore) add(n int64, keys ...string) []int64 {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	us.rollover()
+	totals := make([]int64, len(keys))
+	for i, k := range keys {
+		us.counts[k] += n
+		us.delta[k] += n
+		totals[i] = us.counts[k]
+	}
+	return totals
+}
+
+// Get current total of a counter
+func (us *usageStore) get(key string) int64 {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	us.rollover()
+	return us.counts[key]
+}
+
+// Get a copy of all counters in the current month
+func (us *usageStore) snapshot() usageData {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	us.rollover()
+	f := usageData{Month: us.month, Usage: make(map[string]int64, len(us.counts))}
+	for k, v := range us.counts {
+		f.Usage[k] = v
+	}
+	return f
+}
+
+// Report an exceeded counter once a month, returns true the first time
+func (us *usageStore) warn(key string) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if us.warned[key] {
+		return false
+	}
+	us.warned[key] = true
+	return true
+}
+
+// Check whether a new client may connect to the hostname
+func (us *usageStore) allow(hostname string, suffix string) error {
+	info, ok := auths.find(hostname, suffix)
+	if !ok || info.quotaAction != quotaCut {
+		return nil
+	}
+	if info.quota > 0 && us.get(hostUsageKey(hostname)) >= info.quota {
+		return errQuotaExceeded
+	}
+	if info.ruleQuota > 0 && us.get(ruleUsageKey(info.rule)) >= info.ruleQuota {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// Get quota tracker for a relay session
+func (us *usageStore) track(hostname string, suffix string) *quotaTracker {
+	q := &quotaTracker{hostKey: hostUsageKey(hostname), limiter: newLimiter(0)}
+	if info, ok := auths.find(hostname, suffix); ok {
+		q.ruleKey = ruleUsageKey(info.rule)
+		q.hostQuota = info.quota
+		q.ruleQuota = info.ruleQuota
+		q.action = info.quotaAction
+		q.rate = info.quotaRate
+		if q.action == quotaThrottle && q.exceeded(us.get(q.hostKey), us.get(q.ruleKey)) {
+			setLimit(q.limiter, q.rate)
+		}
+	}
+	return q
+}
+
+func (q *quotaTracker) exceeded(host, rule int64) bool {
+	return (q.hostQuota > 0 && host >= q.hostQuota) || (q.ruleQuota > 0 && rule >= q.ruleQuota)
+}
+
+// Account relayed bytes and enforce quota
+func (q *quotaTracker) account(n int64) error {
+	if q.ruleKey == "" {
+		usage.add(n, q.hostKey)
+		return nil
+	}
+	totals := usage.add(n, q.hostKey, q.ruleKey)
+	if !q.exceeded(totals[0], totals[1]) {
+		return nil
+	}
+	key := q.hostKey
+	if !(q.hostQuota > 0 && totals[0] >= q.hostQuota) {
+		key = q.ruleKey
+	}
+	if usage.warn(key) {
+		metricQuotaExceeded.Add(key, 1)
+		lg.Event(slog.LevelWarn, "quota.exceeded", fmt.Sprintf("Quota of %s exceeded, action: %s", key, q.action), "key", key, "action", string(q.action))
+	}
+	switch q.action {
+	case quotaCut:
+		return errQuotaExceeded
+	case quotaThrottle:
+		if q.limiter.Limit() == rate.Inf {
+			setLimit(q.limiter, q.rate)
+		}
+	}
+	return nil
+}
+
+// Parse quota action option
+func parseQuotaAction(s string) (quotaAction, error) {
+	switch a := quotaAction(s); a {
+	case "":
+		return quotaCut, nil
+	case quotaCut, quotaThrottle, quotaWarn:
+		return a, nil
+	}
+	return "", fmt.Errorf("invalid quota action %s", s)
+}
@@ -0,0 +1,161 @@
+// Bidirectional relay between VPN client and server
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	relayBufferSize       = 32 * 1024
+	relayHalfCloseTimeout = 30 * time.Second // time to wait for the other direction after one side closes
+)
+
+// A relay owns both connections until it returns
+type relay struct {
+	client   net.Conn
+	server   net.Conn
+	limiters func() []*rate.Limiter // bandwidth limits applied to both directions, may change while relaying
+	account  func(n int64) error    // called with relayed bytes, closes the relay on error
+
+	ctx        context.Context // cancelled on close
+	cancel     context.CancelFunc
+	up, down   atomic.Int64 // bytes from client to server and from server to client
+	lastActive atomic.Int64 // unix nano of last transfer
+	eofOnce    sync.Once
+	closedBy   string // side that closed first, guarded by eofOnce
+	closeOnce  sync.Once
+	reason     string // why the relay was closed, guarded by closeOnce
+}
+
+type relayStats struct {
+	up, down int64 // bytes from client to server and from server to client
+	duration time.Duration
+	reason   string
+}
+
+// Relay data in both directions until both sides are closed or a limit is reached
+func (r *relay) run() relayStats {
+	start := time.Now()
+	r.lastActive.Store(start.UnixNano())
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	halfClosed := make(chan struct{}, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.copy(r.server, r.client, &r.up, "client")
+		halfClosed <- struct{}{}
+	}()
+	go func() {
+		defer wg.Done()
+		r.copy(r.client, r.server, &r.down, "server")
+		halfClosed <- struct{}{}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Watch for limits
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var halfCloseTimer <-chan time.Time
+	for {
+		select {
+		case <-done:
+			r.close(r.closedBy + " closed")
+			return relayStats{up: r.up.Load(), down: r.down.Load(), duration: time.Since(start), reason: r.reason}
+		case <-halfClosed:
+			if halfCloseTimer == nil {
+				halfCloseTimer = time.After(relayHalfCloseTimeout)
+			}
+		case <-halfCloseTimer:
+			r.close("other side did not close")
+		case now := <-ticker.C:
+			if *relayIdle > 0 && now.Sub(time.Unix(0, r.lastActive.Load())) > *relayIdle {
+				r.close("idle timeout")
+			}
+			if *relayMax > 0 && now.Sub(start) > *relayMax {
+				r.close("maximum duration reached")
+			}
+		}
+	}
+}
+
+// Copy data in one direction and propagate EOF as half-close
+func (r *relay) copy(dst, src net.Conn, n *atomic.Int64, from string) {
+	b := make([]byte, relayBufferSize)
+	for {
+		nr, err := src.Read(b)
+		if nr > 0 {
+			r.lastActive.Store(time.Now().UnixNano())
+			if r.limiters != nil {
+				for _, l := range r.limiters() {
+					if werr := l.WaitN(r.ctx, nr); werr != nil {
+						r.close(werr.Error())
+						return
+					}
+				}
+			}
+			nw, werr := dst.Write(b[:nr])
+			n.Add(int64(nw))
+			if werr != nil {
+				r.close(werr.Error())
+				return
+			}
+			if r.account != nil {
+				if aerr := r.account(int64(nw)); aerr != nil {
+					r.close(aerr.Error())
+					return
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			r.eofOnce.Do(func() { r.closedBy = from })
+			if closeWrite(dst) != nil {
+				r.close(r.closedBy + " closed")
+			}
+			return
+		}
+		if err != nil {
+			r.close(err.Error())
+			return
+		}
+	}
+}
+
+// Close both connections and record the first reason
+func (r *relay) close(reason string) {
+	r.closeOnce.Do(func() {
+		r.reason = reason
+		r.cancel()
+		r.client.Close()
+		r.server.Close()
+	})
+}
+
+// Shut down the writing side of a connection
+func closeWrite(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.CloseWrite(); err != nil {
+			return err
+		}
+		conn = tlsConn.NetConn()
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
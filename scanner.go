@@ -0,0 +1,194 @@
+// Handling of unknown SNIs from scanners
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions on unknown or empty SNI
+const (
+	unknownReject = "reject" // close before TLS handshake
+	unknownTarpit = "tarpit" // hold connection without response
+	unknownDecoy  = "decoy"  // complete handshake with decoy certificate
+)
+
+var (
+	decoyConfig *tls.Config
+	tarpits     atomic.Int64
+)
+
+// Check -unknown-sni and prepare decoy certificate
+func initUnknownSNI() error {
+	switch *unknownSNI {
+	case unknownReject, unknownTarpit:
+		return nil
+	case unknownDecoy:
+	default:
+		return fmt.Errorf("invalid action on unknown SNI: %s", *unknownSNI)
+	}
+
+	var cert tls.Certificate
+	var err error
+	if *decoyCert != "" {
+		cert, err = tls.LoadX509KeyPair(*decoyCert, *decoyKey)
+	} else {
+		cert, err = selfSignedCert()
+	}
+	if err != nil {
+		return err
+	}
+	decoyConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// Generate a self-signed certificate that looks like a default web server
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().AddDate(-1, 0, 0),
+		NotAfter:     time.Now().AddDate(9, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Handle a connection with unknown or empty SNI.
+// leave releases the pre-authentication slot.
+func handleUnknown(conn net.Conn, leave func()) {
+	switch *unknownSNI {
+	case unknownTarpit:
+		if tarpits.Add(1) > int64(*maxTarpits) {
+			tarpits.Add(-1)
+			metricUnknownSNI.Add(unknownReject, 1)
+			return
+		}
+		defer tarpits.Add(-1)
+		metricUnknownSNI.Add(unknownTarpit, 1)
+		// Tarpits should not hold slots of real clients
+		leave()
+		conn.SetDeadline(time.Now().Add(*tarpitTime))
+		io.Copy(io.Discard, conn)
+	case unknownDecoy:
+		metricUnknownSNI.Add(unknownDecoy, 1)
+		tls.Server(conn, decoyConfig).Handshake()
+	default:
+		metricUnknownSNI.Add(unknownReject, 1)
+	}
+}
+
+// Offenses of a source address
+type offender struct {
+	count int
+	first time.Time
+}
+
+// Thread-safe temporary blocklist of repeat offenders
+type blocklist struct {
+	mu        sync.Mutex
+	offenders map[netip.Addr]*offender
+	blocked   map[netip.Addr]time.Time // expiry
+	pruned    time.Time
+}
+
+// Record an offense and block the address if it repeats too often
+func (bl *blocklist) offend(ip netip.Addr) {
+	// Load balancers carry many clients and are never blocked
+	if *blockAfter <= 0 || !ip.IsValid() || trustedProxyIP(ip) {
+		return
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.offenders == nil {
+		bl.offenders = make(map[netip.Addr]*offender)
+		bl.blocked = make(map[netip.Addr]time.Time)
+	}
+	now := time.Now()
+	if now.Sub(bl.pruned) > time.Minute {
+		bl.prune(now)
+	}
+
+	o := bl.offenders[ip]
+	if o == nil || now.Sub(o.first) > *blockTime {
+		o = &offender{first: now}
+		bl.offenders[ip] = o
+	}
+	o.count++
+	if o.count >= *blockAfter {
+		delete(bl.offenders, ip)
+		bl.blocked[ip] = now.Add(*blockTime)
+		lg.Event(slog.LevelWarn, "scanner.blocked", fmt.Sprintf("Blocked %s for %s after %d unknown SNIs or invalid handshakes", ip, *blockTime, o.count), "remote_ip", ip.String(), "offenses", o.count)
+	}
+}
+
+// Remove expired entries
+func (bl *blocklist) prune(now time.Time) {
+	for ip, o := range bl.offenders {
+		if now.Sub(o.first) > *blockTime {
+			delete(bl.offenders, ip)
+		}
+	}
+	for ip, expiry := range bl.blocked {
+		if now.After(expiry) {
+			delete(bl.blocked, ip)
+		}
+	}
+	bl.pruned = now
+}
+
+// Check whether an address is blocked
+func (bl *blocklist) contains(ip netip.Addr) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	expiry, ok := bl.blocked[ip]
+	if ok && time.Now().After(expiry) {
+		delete(bl.blocked, ip)
+		return false
+	}
+	return ok
+}
+
+// Blocked addresses
+func (bl *blocklist) list() []string {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	now := time.Now()
+	var ips []string
+	for ip, expiry := range bl.blocked {
+		if now.Before(expiry) {
+			ips = append(ips, ip.String())
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
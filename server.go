@@ -5,12 +5,14 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
+
+	"vpnazure-go/internal/logger"
 )
 
 type serverOperation string
@@ -21,53 +23,82 @@ const (
 )
 
 type serverCommand struct {
-	op         serverOperation
-	num        uint64
-	hostname   string
-	sessionID  []byte
-	clientIP   net.IP
-	clientPort int
+	op           serverOperation
+	num          uint64
+	hostname     string
+	sessionID    []byte
+	clientIP     net.IP
+	clientPort   int
+	relayAddress string // relay node chosen by another node, this node if empty
+	relayPort    int
 }
 
-// Handle new server connection
-func handleServer(num uint64, conn *tls.Conn, suffix *suffix) {
-	lg.PrintSessionf("New server connection from %s", num, ' ', 0, conn.RemoteAddr())
+// Handle new server connection.
+// leave releases the pre-authentication slot.
+func handleServer(num uint64, conn net.Conn, suffix *suffix, l *listener, leave func()) {
+	sess := lg.Session(num, ' ', "suffix", suffix.suffix, "remote_ip", ipString(conn.RemoteAddr()), "listener", l.name)
+	sess.Info("server.new", 0, "New server connection from %s on %s%s", geo.describe(conn.RemoteAddr()), l.name, describeHello(conn))
 	conn.SetDeadline(time.Now().Add(serverTimeout))
 	b := make([]byte, 24)
 	n, err := io.ReadAtLeast(conn, b, 4)
 	if err != nil {
-		lg.PrintSessionf("Invalid server connection", num, ' ', 0)
+		sess.Warn("server.invalid", 0, "Invalid server connection")
 		return
 	}
 
 	if bytes.Equal(b[:4], []byte("ACTL")) {
-		lg.PrintSessionf("Starting server control session from %s for suffix %s", num, 'L', 1, conn.RemoteAddr(), suffix.suffix)
-		handleServerControl(num, conn, suffix.suffix)
+		sess.As('L').Info("control.start", 1, "Starting server control session from %s for suffix %s", conn.RemoteAddr(), suffix.suffix)
+		handleServerControl(num, conn, suffix.suffix, leave, sess.As('L'))
 		return
 	}
 
 	if n < 24 {
 		if _, err := io.ReadFull(conn, b[n:]); err != nil {
-			lg.PrintSessionf("Invalid server connection", num, ' ', 0)
+			sess.Warn("server.invalid", 0, "Invalid server connection")
 			return
 		}
 	}
 
 	if bytes.Equal(b, []byte("AZURE_CONNECT_SIGNATURE!")) {
-		lg.PrintSessionf("Starting server data session from %s for suffix %s", num, 'S', 1, conn.RemoteAddr(), suffix.suffix)
-		handleServerData(num, conn)
+		sess.As('S').Info("data.start", 1, "Starting server data session from %s for suffix %s", conn.RemoteAddr(), suffix.suffix)
+		handleServerData(num, conn, leave, sess.As('S'))
 		return
 	}
 
-	lg.PrintSessionf("Invalid server connection", num, ' ', 0)
+	sess.Warn("server.invalid", 0, "Invalid server connection")
 }
 
+// Running control sessions, waited for before exiting
+var controlSessions sync.WaitGroup
+
 // Handle azure control session.
 // conn automatically closes on return, do not fork.
-func handleServerControl(num uint64, conn *tls.Conn, suffix string) {
+func handleServerControl(num uint64, conn net.Conn, suffix string, leave func(), sess logger.Session) {
+	controlSessions.Add(1)
+	defer controlSessions.Done()
+
+	// Record the session when it ends
+	start := time.Now()
+	var hostname, reason string
+	var auth authType
+	defer func() { history.control(num, conn, hostname, suffix, auth, start, reason) }()
+
+	// Check server location
+	var policy geoPolicy
+	if sfx := suffixes.get(suffix); sfx != nil {
+		policy = sfx.geoServer
+	}
+	if loc, ok := geo.permit(conn.RemoteAddr(), geoServer, policy); !ok {
+		metricAuthFailures.Add("location", 1)
+		reason = "server location is not allowed"
+		sess.Warn("control.location_denied", 3, "Session aborted: server location %s is not allowed", loc)
+		return
+	}
+
 	random := make([]byte, 20)
 	if _, err := rand.Read(random); err != nil {
-		lg.PrintSessionf("Failed to generate a random", num, 'L', 3)
+		reason = "failed to generate a random"
+		sess.Error("control.error", 3, "Failed to generate a random")
 		return
 	}
 	// Send control pack to client
@@ -79,70 +110,121 @@ func handleServerControl(num uint64, conn *tls.Conn, suffix string) {
 		"Random":           newPackElementData(random),
 	}}
 	if _, err := p.send(conn, true); err != nil {
-		lg.PrintSessionf("Session aborted: %s", num, 'L', 3, err)
+		reason = err.Error()
+		sess.Warn("control.aborted", 3, "Session aborted: %s", err)
 		return
 	}
 
 	// Receive pack from client
 	p, err := recvPack(conn, true)
 	if err != nil {
-		lg.PrintSessionf("Session aborted: %s", num, 'L', 3, err)
+		reason = err.Error()
+		sess.Warn("control.aborted", 3, "Session aborted: %s", err)
 		return
 	}
 
 	// Authenticate
-	var hostname string
-	state := conn.ConnectionState()
-	if len(state.PeerCertificates) == 0 {
+	peerCerts := peerCertificates(conn)
+	if len(peerCerts) == 0 {
 		var ok bool
 		hostname, ok = p.getString("CurrentHostName", true)
 		if !ok {
-			lg.PrintSessionf("Session aborted: no hostname provided by peer", num, 'L', 3)
+			metricAuthFailures.Add("no hostname", 1)
+			reason = "no hostname provided by peer"
+			sess.Warn("control.auth_failed", 3, "Session aborted: no hostname provided by peer")
 			return
 		}
+		sess = sess.With("hostname", hostname)
 		clientInfo, ok := auths.find(hostname, suffix)
 		if !ok {
-			lg.PrintSessionf("Session aborted: hostname %s is invalid", num, 'L', 3, hostname)
+			metricAuthFailures.Add("invalid hostname", 1)
+			reason = "hostname is invalid"
+			sess.Warn("control.auth_failed", 3, "Session aborted: hostname %s is invalid", hostname)
+			return
+		}
+		if !checkServerSource(sess, conn, clientInfo, hostname) {
+			reason = "server address is not allowed"
 			return
 		}
+		auth = clientInfo.method
 		switch clientInfo.method {
 		case authNone:
-			lg.PrintSessionf("Authentication completed anonymously", num, 'L', 2)
+			sess.Info("control.auth", 2, "Authentication completed anonymously")
 		case authPassword:
 			if hash, ok := p.getData("PasswordHash"); ok && clientInfo.checkPassword(hostname, random, hash) {
-				lg.PrintSessionf("Authentication completed with password", num, 'L', 2)
+				sess.Info("control.auth", 2, "Authentication completed with password")
 			} else {
-				lg.PrintSessionf("Session aborted: incorrect password", num, 'L', 3)
+				metricAuthFailures.Add("password", 1)
+				stats.authFailed(hostname)
+				reason = "incorrect password"
+				sess.Warn("control.auth_failed", 3, "Session aborted: incorrect password")
 				return
 			}
 		case authCert:
 			// Peer should but didn't provide certificate during TLS handshake
-			lg.PrintSessionf("Session aborted: authentication failed with certificate", num, 'L', 3)
+			metricAuthFailures.Add("certificate", 1)
+			stats.authFailed(hostname)
+			reason = "authentication failed with certificate"
+			sess.Warn("control.auth_failed", 3, "Session aborted: authentication failed with certificate")
 			return
 		default:
-			lg.PrintSessionf("Session aborted: unsupported authentication method", num, 'L', 3)
+			metricAuthFailures.Add("unsupported method", 1)
+			stats.authFailed(hostname)
+			reason = "unsupported authentication method"
+			sess.Warn("control.auth_failed", 3, "Session aborted: unsupported authentication method")
 			return
 		}
 	} else {
 		// Already authenticated by TLS
-		hostname = strings.ToLower(state.PeerCertificates[0].Subject.CommonName)
-		lg.PrintSessionf("Authentication completed with certificate", num, 'L', 2)
+		hostname = strings.ToLower(peerCerts[0].Subject.CommonName)
+		sess = sess.With("hostname", hostname)
+		clientInfo, ok := auths.find(hostname, suffix)
+		if !ok {
+			metricAuthFailures.Add("invalid hostname", 1)
+			reason = "hostname is invalid"
+			sess.Warn("control.auth_failed", 3, "Session aborted: hostname %s is invalid", hostname)
+			return
+		}
+		if !checkServerSource(sess, conn, clientInfo, hostname) {
+			reason = "server address is not allowed"
+			return
+		}
+		auth = authCert
+		sess.Info("control.auth", 2, "Authentication completed with certificate")
+	}
+	leave()
+
+	// Damp flapping hostnames
+	delay, err := sessions.checkFlap(num, hostname)
+	if err != nil {
+		reason = err.Error()
+		sess.Warn("control.aborted", 3, "Session aborted: %s", err)
+		return
+	}
+	if delay > 0 {
+		sess.Info("control.delayed", 2, "Delaying registration of flapping hostname for %s", delay)
+		time.Sleep(delay)
+		conn.SetDeadline(time.Now().Add(serverTimeout))
 	}
 
 	// Add session
 	if _, err := conn.Write([]byte{1}); err != nil {
-		lg.PrintSessionf("Session aborted: %s", num, 'L', 3, err)
+		reason = err.Error()
+		sess.Warn("control.aborted", 3, "Session aborted: %s", err)
 		return
 	}
 	if err := serverKeepAlive(conn); err != nil {
-		lg.PrintSessionf("Session aborted: %s", num, 'L', 3, err)
+		reason = err.Error()
+		sess.Warn("control.aborted", 3, "Session aborted: %s", err)
 		return
 	}
 	// unbuffered is ok but may block as sending signal to server takes time
 	ch := make(chan serverCommand, 50)
 	// channel operations other than receiving must be done in sessions to avoid race
-	sessions.addServer(num, hostname, suffix, conn, ch)
-	lg.PrintSessionf("%s is online", num, 'L', 2, hostname)
+	sessions.addServer(num, hostname, suffix, conn, ch, &reason)
+	stats.registered(hostname, suffix)
+	defer stats.disconnected(hostname)
+	sess.Info("control.online", 2, "%s is online", hostname)
 
 	// Session starts
 	ticker := time.NewTicker(30 * time.Second)
@@ -151,7 +233,8 @@ func handleServerControl(num uint64, conn *tls.Conn, suffix string) {
 		select {
 		case c, ok := <-ch:
 			if !ok {
-				lg.PrintSessionf("Session closed", num, 'L', 3)
+				// Removed with a reason by a failure below, a new registration, reload or drain
+				sess.Info("control.closed", 3, "Session closed")
 				return
 			}
 			switch c.op {
@@ -163,14 +246,21 @@ func handleServerControl(num uint64, conn *tls.Conn, suffix string) {
 				if sfx := suffixes.get(suffix); sfx != nil {
 					remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
 					localAddr := conn.LocalAddr().(*net.TCPAddr)
+					relayAddress, relayPort := sfx.control, localAddr.Port
+					if c.relayAddress != "" {
+						relayAddress, relayPort = c.relayAddress, c.relayPort
+					} else if *clusterRelay != "" {
+						// Control hostname may lead to any node in a cluster
+						relayAddress, relayPort, _ = splitRelayAddr(*clusterRelay)
+					}
 					p := pack{elements: map[string]packElement{
 						"opcode":        newPackElementString(string(c.op)),
 						"hostname":      newPackElementString(c.hostname),
 						"session_id":    newPackElementData(c.sessionID),
 						"client_port":   newPackElementInt(uint32(c.clientPort)),
 						"server_port":   newPackElementInt(uint32(remoteAddr.Port)),
-						"relay_address": newPackElementString(sfx.control),
-						"relay_port":    newPackElementInt(uint32(localAddr.Port)),
+						"relay_address": newPackElementString(relayAddress),
+						"relay_port":    newPackElementInt(uint32(relayPort)),
 						"cert_hash":     newPackElementData(sfx.certHash[:]),
 					}}
 					p.addIP("client_ip", c.clientIP)
@@ -180,31 +270,42 @@ func handleServerControl(num uint64, conn *tls.Conn, suffix string) {
 						_, err = p.send(conn, true)
 					}
 					if err == nil {
-						lg.PrintSessionf("Signal sent to the server for client session %d", num, 'L', 2, c.num)
+						sess.With("client_session", c.num).Info("control.signal", 2, "Signal sent to the server for client session %d", c.num)
 						b := make([]byte, 1)
 						_, err = conn.Read(b)
 					} else {
-						lg.PrintSessionf("Failed to send signal to server: %s", num, 'L', 2, err)
+						sess.With("client_session", c.num).Warn("control.signal_failed", 2, "Failed to send signal to server: %s", err)
 					}
 					if err != nil {
-						sessions.delServer(num, hostname)
+						sessions.delServer(num, hostname, err.Error())
 					}
 				} else {
-					lg.PrintSessionf("Suffix %s is no longer valid", num, 'L', 3, suffix)
-					sessions.delServer(num, hostname)
+					sess.Warn("control.suffix_invalid", 3, "Suffix %s is no longer valid", suffix)
+					sessions.delServer(num, hostname, "suffix is no longer valid")
 				}
 			}
 		case <-ticker.C:
 			conn.SetDeadline(time.Now().Add(serverTimeout))
 			if err := serverKeepAlive(conn); err != nil {
 				// if channel is unbuffered, launch as goroutine to avoid deadlock with sending
-				sessions.delServer(num, hostname)
+				sessions.delServer(num, hostname, err.Error())
 			}
 		}
 	}
 }
 
-func serverKeepAlive(conn *tls.Conn) error {
+// Check whether the server may register the hostname from its address
+func checkServerSource(sess logger.Session, conn net.Conn, clientInfo *authInfo, hostname string) bool {
+	if clientInfo.serverACL.permit(addrIP(conn.RemoteAddr())) {
+		return true
+	}
+	metricSourceDenied.Add(hostname, 1)
+	stats.sourceDenied(hostname)
+	sess.Warn("control.source_denied", 3, "Session aborted: %s is not allowed to register %s", conn.RemoteAddr(), hostname)
+	return false
+}
+
+func serverKeepAlive(conn net.Conn) error {
 	if _, err := conn.Write([]byte{0}); err != nil {
 		return err
 	}
@@ -220,38 +321,75 @@ func serverKeepAlive(conn *tls.Conn) error {
 
 // Handle azure data session.
 // conn automatically closes on return, do not fork.
-func handleServerData(num uint64, conn *tls.Conn) {
+func handleServerData(num uint64, conn net.Conn, leave func(), sess logger.Session) {
 	// Receive pack from client
 	p, err := recvPack(conn, true)
 	if err != nil {
-		lg.PrintSessionf("Session aborted: %s", num, 'S', 3, err)
+		sess.Warn("data.aborted", 3, "Session aborted: %s", err)
 		return
 	}
 
 	hostname, ok := p.getString("hostname", false)
 	if !ok {
-		lg.PrintSessionf("Session aborted: no hostname provided by peer", num, 'S', 3)
+		sess.Warn("data.aborted", 3, "Session aborted: no hostname provided by peer")
 		return
 	}
+	sess = sess.With("hostname", hostname)
 
 	sessionID, ok := p.getData("session_id")
 	if !ok || len(sessionID) != 20 {
-		lg.PrintSessionf("Session aborted: failed to get session ID from server", num, 'S', 3)
+		sess.Warn("data.aborted", 3, "Session aborted: failed to get session ID from server")
 		return
 	}
+	leave()
 
-	// Get client connection
-	if cnum, c := sessions.serverRespond(num, conn, hostname, sessionID); c != nil {
-		defer sessions.delRelay(cnum)
-		if _, err := conn.Write([]byte{1}); err != nil {
-			lg.PrintSessionf("Session aborted: %s", num, 'S', 3, err)
-			return
-		}
-		lg.PrintSessionf("Relaying data from client session %d", num, 'S', 2, cnum)
+	if relayPending(num, conn, hostname, sessionID, sess) {
+		return
+	}
+
+	// Client may be waiting on another node
+	if stream, node, err := attachRemote(hostname, sessionID); err == nil {
+		defer stream.Close()
+		sess = sess.With("node", node)
+		sess.Info("data.forwarding", 2, "Relaying data for client session on node %s", node)
 		conn.SetDeadline(time.Time{})
-		n, _ := io.Copy(conn, c)
-		lg.PrintSessionf("Server session closed: relayed %d bytes from client to server", num, 'S', 3, n)
-	} else {
-		lg.PrintSessionf("Session aborted: can't find the client session", num, 'S', 3)
+		r := relay{client: stream, server: conn}
+		st := r.run()
+		sess.With("reason", st.reason, "client_bytes", st.up, "server_bytes", st.down).Info("data.closed", 3, "Server session closed (%s): forwarded %d bytes to and %d bytes from node %s in %s",
+			st.reason, st.up, st.down, node, st.duration.Round(time.Second))
+		return
+	}
+	sess.Warn("data.not_found", 3, "Session aborted: can't find the client session")
+}
+
+// Relay a server data session to its pending client.
+// Returns false if the client session is not found.
+func relayPending(num uint64, conn net.Conn, hostname string, sessionID []byte, sess logger.Session) bool {
+	done := make(chan struct{})
+	cnum, c, ok := sessions.serverRespond(num, conn, hostname, sessionID, done)
+	if !ok {
+		return false
+	}
+	defer sessions.delRelay(cnum)
+	sess = sess.With("client_session", cnum)
+	defer close(done)
+	if _, err := conn.Write([]byte{1}); err != nil {
+		sess.Warn("data.aborted", 3, "Session aborted: %s", err)
+		return true
 	}
+	sess.Info("data.relaying", 2, "Relaying data for client session %d", cnum)
+	conn.SetDeadline(time.Time{})
+	q := usage.track(hostname, c.suffix)
+	shaped := bandwidth.acquire(cnum, hostname, c.suffix, q.limiter)
+	defer bandwidth.release(cnum)
+	r := relay{client: c.conn, server: conn, limiters: shaped.current, account: q.account}
+	start := time.Now()
+	st := r.run()
+	metricRelayBytes.Add("client_to_server", st.up)
+	metricRelayBytes.Add("server_to_client", st.down)
+	stats.relayed(hostname, st.up, st.down)
+	history.relay(num, cnum, c, conn, start, st)
+	sess.With("reason", st.reason, "client_bytes", st.up, "server_bytes", st.down).Info("data.closed", 3, "Server session closed (%s): relayed %d bytes from client to server and %d bytes from server to client in %s",
+		st.reason, st.up, st.down, st.duration.Round(time.Second))
+	return true
 }
@@ -3,22 +3,30 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/tls"
 	"errors"
+	"math"
 	"net"
+	"sort"
 	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
 type pendingSession struct {
 	conn      net.Conn             // client connection
 	ch        chan<- clientCommand // channel to notify client of server connection
 	hostname  string               // server FQDN
+	suffix    string               // server suffix
 	sessionID []byte               // 20-byte session ID
 }
 
 type relayingSession struct {
-	client net.Addr
-	server net.Addr
+	hostname string
+	suffix   string
+	client   net.Addr
+	server   net.Addr
+	hello    *clientHello // client ClientHello
 }
 
 type serverSession struct {
@@ -26,39 +34,134 @@ type serverSession struct {
 	suffix string               // server suffix
 	conn   net.Conn             // server control connection
 	ch     chan<- serverCommand // channel to send server command
+	reason *string              // why the session is closed, set before closing the channel
+}
+
+// Close the channel of a removed server with the reason
+func (s serverSession) close(reason string) {
+	*s.reason = reason
+	close(s.ch)
+}
+
+// Client sessions of a hostname
+type hostLoad struct {
+	pending  int
+	relaying int
+}
+
+// Reasons to refuse a client
+var (
+	errServerOffline  = errors.New("server is offline")
+	errServerBusy     = errors.New("server is busy")
+	errTooManyRelays  = errors.New("too many relays to the server")
+	errTooManyPending = errors.New("too many pending requests to the server")
+	errConnRate       = errors.New("too many new connections to the server")
+)
+
+// Registration history of a hostname
+type flapState struct {
+	registrations []time.Time // accepted registrations within the flap window
+	flapping      bool
 }
 
 type sessionList struct {
 	pending  map[uint64]pendingSession
 	relaying map[uint64]relayingSession
 	servers  map[string]serverSession
+	flaps    map[string]*flapState
+	connRate map[string]*rate.Limiter // new client connections by hostname, kept across registrations
+	load     map[string]*hostLoad     // client sessions by hostname
 	c, s     sync.Mutex
 }
 
-// Register a new server
-func (sl *sessionList) addServer(num uint64, hostname string, suffix string, conn *tls.Conn, ch chan serverCommand) {
+// Register a new server.
+// reason is set when the session is removed.
+func (sl *sessionList) addServer(num uint64, hostname string, suffix string, conn net.Conn, ch chan serverCommand, reason *string) {
 	sl.s.Lock()
 	defer sl.s.Unlock()
 
 	// Replace existing session if any
 	if s, ok := sl.servers[hostname]; ok {
-		close(s.ch)
+		s.close("replaced by a new registration")
+	}
+	sl.servers[hostname] = serverSession{num: num, suffix: suffix, conn: conn, ch: ch, reason: reason}
+	cluster.register(hostname, suffix)
+}
+
+// Record a server registration and apply damping if the hostname is flapping.
+// Returns the delay before the registration may be accepted.
+func (sl *sessionList) checkFlap(num uint64, hostname string) (time.Duration, error) {
+	if *flapLimit <= 0 {
+		return 0, nil
+	}
+
+	sl.s.Lock()
+	defer sl.s.Unlock()
+
+	f, ok := sl.flaps[hostname]
+	if !ok {
+		f = &flapState{}
+		sl.flaps[hostname] = f
+	}
+
+	// Forget registrations out of the window
+	now := time.Now()
+	i := 0
+	for i < len(f.registrations) && now.Sub(f.registrations[i]) > *flapWindow {
+		i++
+	}
+	f.registrations = f.registrations[i:]
+
+	if f.flapping {
+		if len(f.registrations) < *flapLimit {
+			f.flapping = false
+			lg.Session(num, 'L', "hostname", hostname).Info("control.flapping_stopped", 2, "%s is no longer flapping", hostname)
+		} else if now.Sub(f.registrations[len(f.registrations)-1]) < *flapHold {
+			return 0, errors.New("re-registration is rate limited")
+		}
+	}
+
+	f.registrations = append(f.registrations, now)
+	if !f.flapping && len(f.registrations) > *flapLimit {
+		f.flapping = true
+		metricFlaps.Add(hostname, 1)
+		lg.Session(num, 'L', "hostname", hostname).Warn("control.flapping", 2, "%s is flapping: %d registrations within %s", hostname, len(f.registrations), *flapWindow)
+	}
+
+	if f.flapping {
+		return *flapDelay, nil
+	}
+	return 0, nil
+}
+
+// List hostnames that are currently flapping
+func (sl *sessionList) flappingHosts() []string {
+	sl.s.Lock()
+	defer sl.s.Unlock()
+
+	hosts := []string{}
+	for hostname, f := range sl.flaps {
+		if f.flapping {
+			hosts = append(hosts, hostname)
+		}
 	}
-	sl.servers[hostname] = serverSession{num: num, suffix: suffix, conn: conn, ch: ch}
+	sort.Strings(hosts)
+	return hosts
 }
 
 // Remove a server
-func (sl *sessionList) delServer(num uint64, hostname string) {
+func (sl *sessionList) delServer(num uint64, hostname string, reason string) {
 	sl.s.Lock()
 	defer sl.s.Unlock()
 
 	if s, ok := sl.servers[hostname]; ok && s.num == num {
 		delete(sl.servers, hostname)
-		close(s.ch)
+		s.close(reason)
+		cluster.unregister(hostname)
 	}
 }
 
-// Remove outdated servers
+// Remove outdated servers, registration histories out of the flap window and unused rate limiters
 func (sl *sessionList) cleanupServers() {
 	sl.s.Lock()
 	defer sl.s.Unlock()
@@ -66,9 +169,47 @@ func (sl *sessionList) cleanupServers() {
 	for hostname, s := range sl.servers {
 		if _, ok := auths.find(hostname, s.suffix); !ok {
 			delete(sl.servers, hostname)
-			close(s.ch)
+			s.close("credential removed")
+			cluster.unregister(hostname)
 		}
 	}
+	now := time.Now()
+	for hostname, f := range sl.flaps {
+		if len(f.registrations) == 0 || now.Sub(f.registrations[len(f.registrations)-1]) > *flapWindow {
+			delete(sl.flaps, hostname)
+		}
+	}
+	for hostname, l := range sl.connRate {
+		// A full bucket carries no state
+		if _, ok := sl.servers[hostname]; !ok && (l.Limit() == rate.Inf || l.Tokens() >= float64(l.Burst())) {
+			delete(sl.connRate, hostname)
+		}
+	}
+}
+
+// Hostnames of registered servers, sorted
+func (sl *sessionList) serverHosts() []string {
+	sl.s.Lock()
+	defer sl.s.Unlock()
+
+	hosts := make([]string, 0, len(sl.servers))
+	for hostname := range sl.servers {
+		hosts = append(hosts, hostname)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Close the control session of a server so it reconnects
+func (sl *sessionList) closeServer(hostname string, reason string) {
+	sl.s.Lock()
+	defer sl.s.Unlock()
+
+	if s, ok := sl.servers[hostname]; ok {
+		delete(sl.servers, hostname)
+		s.close(reason)
+		cluster.unregister(hostname)
+	}
 }
 
 // Send client request to a server control session
@@ -80,18 +221,12 @@ func (sl *sessionList) clientRequest(num uint64, hostname string, conn net.Conn,
 	// Find server session
 	s, ok := sl.servers[hostname]
 	if !ok {
-		return errors.New("server is offline")
+		return errServerOffline
 	}
 
 	// sending may block when buffer is full (remove if unbuffered)
 	if len(s.ch) == cap(s.ch) {
-		return errors.New("server is busy")
-	}
-
-	// generate a secure session ID
-	id := make([]byte, 20)
-	if _, err := rand.Read(id); err != nil {
-		return errors.New("failed to generate a session ID")
+		return errServerBusy
 	}
 
 	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
@@ -99,10 +234,20 @@ func (sl *sessionList) clientRequest(num uint64, hostname string, conn net.Conn,
 		return errors.New("failed to get client address")
 	}
 
-	// Save client session
+	// Check admission limits of the hostname, refused clients do not use up the connection rate
+	maxRelays, maxPending, connRate := admissionLimits(hostname, s.suffix)
 	sl.c.Lock()
 	defer sl.c.Unlock()
-	sl.pending[num] = pendingSession{conn: conn, ch: ch, hostname: hostname, sessionID: id}
+	if err := sl.checkLoad(hostname, maxRelays, maxPending); err != nil {
+		return err
+	}
+	if !sl.allowConn(hostname, connRate) {
+		return errConnRate
+	}
+	id, err := sl.addPending(num, hostname, s.suffix, conn, ch)
+	if err != nil {
+		return err
+	}
 
 	// Send connection info to server
 	command := serverCommand{op: serverRelay, num: num, hostname: hostname, sessionID: id, clientIP: addr.IP, clientPort: addr.Port}
@@ -111,30 +256,191 @@ func (sl *sessionList) clientRequest(num uint64, hostname string, conn net.Conn,
 	return nil
 }
 
+// Save a client session waiting for a server on another node.
+// Returns the session ID to be sent to the server.
+func (sl *sessionList) remoteRequest(num uint64, hostname string, suffix string, conn net.Conn, ch chan clientCommand) ([]byte, error) {
+	maxRelays, maxPending, _ := admissionLimits(hostname, suffix)
+	sl.c.Lock()
+	defer sl.c.Unlock()
+	if err := sl.checkLoad(hostname, maxRelays, maxPending); err != nil {
+		return nil, err
+	}
+	return sl.addPending(num, hostname, suffix, conn, ch)
+}
+
+// Check whether a hostname can take another client.
+// Must be called with client lock held.
+func (sl *sessionList) checkLoad(hostname string, maxRelays, maxPending int) error {
+	if err := drains.check(hostname); err != nil {
+		return err
+	}
+	if load := sl.load[hostname]; load != nil {
+		if maxRelays > 0 && load.relaying >= maxRelays {
+			return errTooManyRelays
+		}
+		if maxPending > 0 && load.pending >= maxPending {
+			return errTooManyPending
+		}
+	}
+	return nil
+}
+
+// Take a token from the connection rate limiter of a hostname.
+// Must be called with server lock held.
+func (sl *sessionList) allowConn(hostname string, connRate float64) bool {
+	l, ok := sl.connRate[hostname]
+	if !ok {
+		l = rate.NewLimiter(rate.Inf, 1)
+		sl.connRate[hostname] = l
+	}
+	setConnRate(l, connRate)
+	return l.Allow()
+}
+
+// Save a pending client session after its limits are checked.
+// Must be called with client lock held.
+func (sl *sessionList) addPending(num uint64, hostname string, suffix string, conn net.Conn, ch chan clientCommand) ([]byte, error) {
+	load := sl.load[hostname]
+	if load == nil {
+		load = &hostLoad{}
+		sl.load[hostname] = load
+	}
+
+	// generate a secure session ID, tagged with this node for servers on other nodes
+	id := make([]byte, 20)
+	if _, err := rand.Read(id[len(localTag):]); err != nil {
+		return nil, errors.New("failed to generate a session ID")
+	}
+	copy(id, localTag)
+
+	sl.pending[num] = pendingSession{conn: conn, ch: ch, hostname: hostname, suffix: suffix, sessionID: id}
+	load.pending++
+	return id, nil
+}
+
+// Send relay request of a client on another node to a local server
+func (sl *sessionList) relayRequest(command serverCommand) error {
+	sl.s.Lock()
+	defer sl.s.Unlock()
+
+	s, ok := sl.servers[command.hostname]
+	if !ok {
+		return errServerOffline
+	}
+	if err := drains.check(command.hostname); err != nil {
+		return err
+	}
+	if len(s.ch) == cap(s.ch) {
+		return errServerBusy
+	}
+	// Load limits were checked by the node of the client
+	_, _, connRate := admissionLimits(command.hostname, s.suffix)
+	if !sl.allowConn(command.hostname, connRate) {
+		return errConnRate
+	}
+	s.ch <- command
+	return nil
+}
+
+// Check whether a client session is waiting for the server
+func (sl *sessionList) hasPending(hostname string, sessionID []byte) bool {
+	sl.c.Lock()
+	defer sl.c.Unlock()
+	for _, c := range sl.pending {
+		if c.hostname == hostname && bytes.Equal(c.sessionID, sessionID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of pending and relaying client sessions
+func (sl *sessionList) clientCount() int {
+	sl.c.Lock()
+	defer sl.c.Unlock()
+	return len(sl.pending) + len(sl.relaying)
+}
+
+// Number of pending client sessions
+func (sl *sessionList) pendingCount() int {
+	sl.c.Lock()
+	defer sl.c.Unlock()
+	return len(sl.pending)
+}
+
+// Get admission limits of a hostname, 0 for unlimited
+func admissionLimits(hostname string, suffix string) (maxRelays, maxPending int, connRate float64) {
+	maxRelays, maxPending, connRate = *maxHostRelays, *maxHostPending, *hostConnRate
+	if info, ok := auths.find(hostname, suffix); ok {
+		if info.maxRelays > 0 {
+			maxRelays = info.maxRelays
+		}
+		if info.maxPending > 0 {
+			maxPending = info.maxPending
+		}
+		if info.connRate > 0 {
+			connRate = info.connRate
+		}
+	}
+	return
+}
+
+// Apply connection rate per second to a limiter, 0 for unlimited
+func setConnRate(l *rate.Limiter, connRate float64) {
+	if connRate <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	if l.Limit() != rate.Limit(connRate) {
+		l.SetBurst(max(1, int(math.Ceil(connRate))))
+		l.SetLimit(rate.Limit(connRate))
+	}
+}
+
+// Remove a client session from hostname load.
+// Must be called with lock held.
+func (sl *sessionList) unload(hostname string, pending, relaying int) {
+	if load := sl.load[hostname]; load != nil {
+		load.pending -= pending
+		load.relaying -= relaying
+		if load.pending <= 0 && load.relaying <= 0 {
+			delete(sl.load, hostname)
+		}
+	}
+}
+
 // Client cancels a request
 func (sl *sessionList) delRequest(num uint64) {
 	sl.c.Lock()
 	defer sl.c.Unlock()
 
-	delete(sl.pending, num)
+	if c, ok := sl.pending[num]; ok {
+		delete(sl.pending, num)
+		sl.unload(c.hostname, 1, 0)
+	}
 }
 
-// Server responds and gets the pending client connection
-func (sl *sessionList) serverRespond(num uint64, conn net.Conn, hostname string, sessionID []byte) (uint64, net.Conn) {
+// Server responds and gets the pending client session.
+// done should be closed when the relay ends.
+func (sl *sessionList) serverRespond(num uint64, conn net.Conn, hostname string, sessionID []byte, done <-chan struct{}) (uint64, pendingSession, bool) {
 	sl.c.Lock()
 	defer sl.c.Unlock()
 
 	for cnum, c := range sl.pending {
 		if c.hostname == hostname && bytes.Equal(c.sessionID, sessionID) {
 			delete(sl.pending, cnum)
-			sl.relaying[cnum] = relayingSession{client: c.conn.RemoteAddr(), server: conn.RemoteAddr()}
+			sl.relaying[cnum] = relayingSession{hostname: hostname, suffix: c.suffix, client: c.conn.RemoteAddr(), server: conn.RemoteAddr(), hello: connHello(c.conn)}
+			if load := sl.load[hostname]; load != nil {
+				load.pending--
+				load.relaying++
+			}
 			// This channel will be sent to at most once and will never block
-			c.ch <- clientCommand{num: num, conn: conn}
-			return cnum, c.conn
+			c.ch <- clientCommand{num: num, done: done}
+			return cnum, c, true
 		}
 	}
 
-	return 0, nil
+	return 0, pendingSession{}, false
 }
 
 // Remove a relay session
@@ -142,7 +448,46 @@ func (sl *sessionList) delRelay(num uint64) {
 	sl.c.Lock()
 	defer sl.c.Unlock()
 
-	delete(sl.relaying, num)
+	if r, ok := sl.relaying[num]; ok {
+		delete(sl.relaying, num)
+		sl.unload(r.hostname, 0, 1)
+	}
+}
+
+// List sessions for admin API
+func (sl *sessionList) list() (servers, pending, relaying []adminSession) {
+	sl.s.Lock()
+	servers = make([]adminSession, 0, len(sl.servers))
+	for hostname, s := range sl.servers {
+		as := adminSession{Session: s.num, Hostname: hostname, Suffix: s.suffix}
+		as.setAddress(s.conn.RemoteAddr())
+		as.setFingerprint(connHello(s.conn))
+		servers = append(servers, as)
+	}
+	sl.s.Unlock()
+
+	sl.c.Lock()
+	pending = make([]adminSession, 0, len(sl.pending))
+	for num, c := range sl.pending {
+		as := adminSession{Session: num, Hostname: c.hostname, Suffix: c.suffix}
+		as.setAddress(c.conn.RemoteAddr())
+		as.setFingerprint(connHello(c.conn))
+		pending = append(pending, as)
+	}
+	relaying = make([]adminSession, 0, len(sl.relaying))
+	for num, r := range sl.relaying {
+		as := adminSession{Session: num, Hostname: r.hostname, Suffix: r.suffix}
+		as.setAddress(r.client)
+		as.setServerAddress(r.server)
+		as.setFingerprint(r.hello)
+		relaying = append(relaying, as)
+	}
+	sl.c.Unlock()
+
+	for _, list := range [][]adminSession{servers, pending, relaying} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Session < list[j].Session })
+	}
+	return
 }
 
 // Print session statistics
@@ -0,0 +1,211 @@
+// Bandwidth shaping with token buckets
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// A token bucket shared by relays in the same scope
+type bucket struct {
+	limiter *rate.Limiter
+	refs    int
+}
+
+// Relay session being shaped
+type shapedSession struct {
+	hostname string
+	suffix   string
+	rule     string // credential line currently matched
+	limiter  *rate.Limiter
+	extra    []*rate.Limiter                 // limits from outside the shaper
+	limiters atomic.Pointer[[]*rate.Limiter] // replaced when the session moves to another rule
+}
+
+// Get the limiters currently applied to the relay
+func (ss *shapedSession) current() []*rate.Limiter {
+	return *ss.limiters.Load()
+}
+
+// Apply the limiters of the current buckets.
+// Must be called with lock held.
+func (sh *shaper) link(ss *shapedSession) {
+	limiters := []*rate.Limiter{sh.global, sh.suffixes[ss.suffix].limiter, sh.rules[ss.rule].limiter, sh.hosts[ss.hostname].limiter, ss.limiter}
+	limiters = append(limiters, ss.extra...)
+	ss.limiters.Store(&limiters)
+}
+
+// Bandwidth limits by scope.
+// Limits apply to the sum of both directions.
+type shaper struct {
+	globalRate  int64 // bytes per second for all relays
+	sessionRate int64 // default bytes per second for each relay
+	global      *rate.Limiter
+	suffixes    map[string]*bucket
+	rules       map[string]*bucket // by credential line
+	hosts       map[string]*bucket
+	sessions    map[uint64]*shapedSession
+	mu          sync.Mutex
+}
+
+// Create a limiter, 0 means unlimited
+func newLimiter(bytesPerSec int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, relayBufferSize)
+	setLimit(l, bytesPerSec)
+	return l
+}
+
+// Change a limiter in place so that running relays pick it up
+func setLimit(l *rate.Limiter, bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	// Burst must allow a full read buffer
+	l.SetBurst(max(int(bytesPerSec), relayBufferSize))
+	l.SetLimit(rate.Limit(bytesPerSec))
+}
+
+// Initialize with default limits
+func (sh *shaper) init(globalRate, sessionRate int64) {
+	sh.globalRate = globalRate
+	sh.sessionRate = sessionRate
+	sh.global = newLimiter(globalRate)
+	sh.suffixes = make(map[string]*bucket)
+	sh.rules = make(map[string]*bucket)
+	sh.hosts = make(map[string]*bucket)
+	sh.sessions = make(map[uint64]*shapedSession)
+}
+
+// Get limiters for a new relay session identified by client session number.
+// Extra limiters are applied after the shaper's own.
+func (sh *shaper) acquire(num uint64, hostname string, suffix string, extra ...*rate.Limiter) *shapedSession {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	rule, suffixRate, ruleRate, hostRate, sessionRate := sh.rates(hostname, suffix)
+
+	s, ok := sh.suffixes[suffix]
+	if !ok {
+		s = &bucket{limiter: newLimiter(suffixRate)}
+		sh.suffixes[suffix] = s
+	}
+	s.refs++
+
+	sh.enterRule(rule, ruleRate)
+
+	h, ok := sh.hosts[hostname]
+	if !ok {
+		h = &bucket{limiter: newLimiter(hostRate)}
+		sh.hosts[hostname] = h
+	}
+	h.refs++
+
+	ss := &shapedSession{hostname: hostname, suffix: suffix, rule: rule, limiter: newLimiter(sessionRate), extra: extra}
+	sh.link(ss)
+	sh.sessions[num] = ss
+	return ss
+}
+
+// Add a reference to the bucket of a credential line, creating it if needed.
+// Must be called with lock held.
+func (sh *shaper) enterRule(rule string, ruleRate int64) {
+	r, ok := sh.rules[rule]
+	if !ok {
+		r = &bucket{limiter: newLimiter(ruleRate)}
+		sh.rules[rule] = r
+	}
+	r.refs++
+}
+
+// Drop a reference to the bucket of a credential line.
+// Must be called with lock held.
+func (sh *shaper) leaveRule(rule string) {
+	if r := sh.rules[rule]; r != nil {
+		if r.refs--; r.refs == 0 {
+			delete(sh.rules, rule)
+		}
+	}
+}
+
+// Release limiters of a finished relay session
+func (sh *shaper) release(num uint64) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	ss, ok := sh.sessions[num]
+	if !ok {
+		return
+	}
+	delete(sh.sessions, num)
+	if s := sh.suffixes[ss.suffix]; s != nil {
+		if s.refs--; s.refs == 0 {
+			delete(sh.suffixes, ss.suffix)
+		}
+	}
+	sh.leaveRule(ss.rule)
+	if h := sh.hosts[ss.hostname]; h != nil {
+		if h.refs--; h.refs == 0 {
+			delete(sh.hosts, ss.hostname)
+		}
+	}
+}
+
+// Change default limits at runtime
+func (sh *shaper) setDefaults(globalRate, sessionRate int64) {
+	sh.mu.Lock()
+	sh.globalRate = globalRate
+	sh.sessionRate = sessionRate
+	sh.mu.Unlock()
+	sh.update()
+}
+
+// Get default limits
+func (sh *shaper) defaults() (globalRate, sessionRate int64) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.globalRate, sh.sessionRate
+}
+
+// Apply current configuration to running relays
+func (sh *shaper) update() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	setLimit(sh.global, sh.globalRate)
+	for _, ss := range sh.sessions {
+		// Relays move to the bucket of the line they match now
+		rule, suffixRate, ruleRate, hostRate, sessionRate := sh.rates(ss.hostname, ss.suffix)
+		if rule != ss.rule {
+			sh.leaveRule(ss.rule)
+			sh.enterRule(rule, ruleRate)
+			ss.rule = rule
+			sh.link(ss)
+		}
+		setLimit(sh.suffixes[ss.suffix].limiter, suffixRate)
+		setLimit(sh.rules[ss.rule].limiter, ruleRate)
+		setLimit(sh.hosts[ss.hostname].limiter, hostRate)
+		setLimit(ss.limiter, sessionRate)
+	}
+}
+
+// Look up the matching credential line and configured limits for a relay session.
+// Must be called with lock held.
+func (sh *shaper) rates(hostname string, suffix string) (rule string, suffixRate, ruleRate, hostRate, sessionRate int64) {
+	if sfx := suffixes.get(suffix); sfx != nil {
+		suffixRate = sfx.rate
+	}
+	sessionRate = sh.sessionRate
+	if info, ok := auths.find(hostname, suffix); ok {
+		rule = info.rule
+		ruleRate = info.ruleRate
+		hostRate = info.rate
+		if info.sessionRate > 0 {
+			sessionRate = info.sessionRate
+		}
+	}
+	return
+}
@@ -5,7 +5,9 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,7 +15,7 @@ import (
 
 func listenSignal() {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR2)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 	for sig := range sigs {
 		switch sig {
 		case syscall.SIGHUP:
@@ -25,6 +27,9 @@ func listenSignal() {
 			} else {
 				log.Fatalf("At least 1 DNS suffix is needed")
 			}
+			if err := checkGeoPolicies(); err != nil {
+				log.Fatalln(err)
+			}
 
 			// Read server credentials
 			if n := auths.read(*authFile); n > 0 {
@@ -33,8 +38,21 @@ func listenSignal() {
 				log.Fatalf("At least 1 server credential is needed")
 			}
 
+			// Read passthrough backends
+			if *passthroughFile != "" {
+				lg.Printf("Loaded %d passthrough backends", passthroughs.read(*passthroughFile))
+			}
+
 			// Remove outdated server control sessions
 			sessions.cleanupServers()
+
+			// Apply new bandwidth limits to running relays
+			bandwidth.update()
+		case syscall.SIGUSR1:
+			lg.Println("Received signal to upgrade")
+			if err := upgrade(); err != nil {
+				lg.Event(slog.LevelError, "upgrade.failed", fmt.Sprintf("Upgrade failed: %s", err), "error", err.Error())
+			}
 		case syscall.SIGUSR2:
 			if *logFile == "" {
 				break
@@ -0,0 +1,264 @@
+// Statistics of hostnames kept across restarts
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	statsFlushInterval = time.Minute
+	statsPruneInterval = time.Hour
+)
+
+var statsBucket = []byte("hosts")
+
+var errStatsDisabled = errors.New("statistics are disabled")
+
+// Statistics of a hostname
+type hostStats struct {
+	Hostname      string    `json:"hostname"`
+	Suffix        string    `json:"suffix,omitempty"`
+	Online        bool      `json:"online"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"` // last registration or disconnection
+	Registrations int64     `json:"registrations"`
+	AuthFailures  int64     `json:"auth_failures"`
+	SourceDenied  int64     `json:"source_denied"` // registrations from addresses not allowed for the hostname
+	Relays        int64     `json:"relays"`
+	ClientBytes   int64     `json:"client_bytes"` // relayed from clients to the server
+	ServerBytes   int64     `json:"server_bytes"` // relayed from the server to clients
+}
+
+// Add changes of a hostname
+func (hs *hostStats) merge(d *hostStats) {
+	if d.Suffix != "" {
+		hs.Suffix = d.Suffix
+	}
+	if hs.FirstSeen.IsZero() || !d.FirstSeen.IsZero() && d.FirstSeen.Before(hs.FirstSeen) {
+		hs.FirstSeen = d.FirstSeen
+	}
+	if d.LastSeen.After(hs.LastSeen) {
+		hs.LastSeen = d.LastSeen
+	}
+	hs.Registrations += d.Registrations
+	hs.AuthFailures += d.AuthFailures
+	hs.SourceDenied += d.SourceDenied
+	hs.Relays += d.Relays
+	hs.ClientBytes += d.ClientBytes
+	hs.ServerBytes += d.ServerBytes
+}
+
+// Statistics saved to a bbolt database
+type statsStore struct {
+	mu     sync.Mutex
+	file   string
+	delta  map[string]*hostStats // unsaved changes by hostname
+	pruned time.Time
+}
+
+// Create the database and start saving periodically if a file is given
+func (ss *statsStore) open(file string) error {
+	ss.file = file
+	ss.delta = make(map[string]*hostStats)
+	if file == "" {
+		return nil
+	}
+	err := updateBucket(file, statsBucket, func(b *bolt.Bucket) error { return nil })
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(statsFlushInterval) {
+			if err := ss.flush(); err != nil {
+				lg.Event(slog.LevelError, "stats.save_failed", fmt.Sprintf("stats: error saving %s: %s", ss.file, err), "file", ss.file, "error", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// Record a change of a hostname
+func (ss *statsStore) add(hostname string, change func(*hostStats)) {
+	if ss.file == "" {
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	d, ok := ss.delta[hostname]
+	if !ok {
+		d = &hostStats{Hostname: hostname}
+		ss.delta[hostname] = d
+	}
+	change(d)
+}
+
+// Record a registration of a server
+func (ss *statsStore) registered(hostname string, suffix string) {
+	ss.add(hostname, func(d *hostStats) {
+		now := time.Now()
+		d.Suffix = suffix
+		if d.FirstSeen.IsZero() {
+			d.FirstSeen = now
+		}
+		d.LastSeen = now
+		d.Registrations++
+	})
+}
+
+// Record a disconnection of a server
+func (ss *statsStore) disconnected(hostname string) {
+	ss.add(hostname, func(d *hostStats) { d.LastSeen = time.Now() })
+}
+
+// Record a failed authentication of a known hostname
+func (ss *statsStore) authFailed(hostname string) {
+	ss.add(hostname, func(d *hostStats) { d.AuthFailures++ })
+}
+
+// Record a registration refused by source address
+func (ss *statsStore) sourceDenied(hostname string) {
+	ss.add(hostname, func(d *hostStats) { d.SourceDenied++ })
+}
+
+// Record a finished relay
+func (ss *statsStore) relayed(hostname string, up int64, down int64) {
+	ss.add(hostname, func(d *hostStats) {
+		d.Relays++
+		d.ClientBytes += up
+		d.ServerBytes += down
+	})
+}
+
+// Merge unsaved changes into the database and remove hostnames not seen within retention
+func (ss *statsStore) flush() error {
+	if ss.file == "" {
+		return nil
+	}
+	// Sessions record statistics with their lock held, so collect before locking
+	online := make(map[string]bool)
+	for _, hostname := range sessions.serverHosts() {
+		online[hostname] = true
+	}
+
+	// Take unsaved changes so that recording does not wait for the database
+	ss.mu.Lock()
+	now := time.Now()
+	prune := *statsRetention > 0 && now.Sub(ss.pruned) >= statsPruneInterval
+	delta := ss.delta
+	ss.delta = make(map[string]*hostStats)
+	ss.mu.Unlock()
+	if len(delta) == 0 && !prune {
+		return nil
+	}
+
+	err := updateBucket(ss.file, statsBucket, func(b *bolt.Bucket) error {
+		for hostname, d := range delta {
+			var hs hostStats
+			if v := b.Get([]byte(hostname)); v != nil {
+				if err := json.Unmarshal(v, &hs); err != nil {
+					return err
+				}
+			}
+			hs.merge(d)
+			hs.Hostname = hostname
+			v, err := json.Marshal(hs)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(hostname), v); err != nil {
+				return err
+			}
+		}
+		if !prune {
+			return nil
+		}
+
+		// Deleting while iterating skips keys, so collect first
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var hs hostStats
+			if json.Unmarshal(v, &hs) == nil && !online[hs.Hostname] && now.Sub(hs.LastSeen) > *statsRetention {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if err != nil {
+		// Keep changes for the next try, later ones on top
+		for hostname, d := range ss.delta {
+			if old, ok := delta[hostname]; ok {
+				old.merge(d)
+			} else {
+				delta[hostname] = d
+			}
+		}
+		ss.delta = delta
+		return err
+	}
+	if prune {
+		ss.pruned = now
+	}
+	return nil
+}
+
+// Get saved statistics of a hostname, or all if empty
+func (ss *statsStore) query(hostname string) ([]hostStats, error) {
+	if ss.file == "" {
+		return nil, errStatsDisabled
+	}
+	if err := ss.flush(); err != nil {
+		return nil, err
+	}
+	list := []hostStats{}
+	err := viewBucket(ss.file, statsBucket, func(b *bolt.Bucket) error {
+		add := func(v []byte) error {
+			var hs hostStats
+			if err := json.Unmarshal(v, &hs); err != nil {
+				return err
+			}
+			list = append(list, hs)
+			return nil
+		}
+		if hostname != "" {
+			if v := b.Get([]byte(hostname)); v != nil {
+				return add(v)
+			}
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error { return add(v) })
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	online := make(map[string]bool)
+	for _, hostname := range sessions.serverHosts() {
+		online[hostname] = true
+	}
+	for i := range list {
+		list[i].Online = online[list[i].Hostname]
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hostname < list[j].Hostname })
+	return list, nil
+}
@@ -0,0 +1,284 @@
+// Relaying clients of servers connected to other nodes
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Relay node choices of -relay-steering
+const (
+	steerClient  = "client"  // node where the client is
+	steerControl = "control" // node where the server is
+	steerLeast   = "least"   // least loaded node
+
+	nodeDialTimeout    = 2 * time.Second
+	relayUpgrade       = "vpnazure-relay"
+	nodeTagSize        = 4    // leading bytes of session IDs that identify the node of the client
+	maxNodeRequestSize = 4096 // bytes of relay and attach requests
+)
+
+// Request to a control node to signal its server
+type nodeRelayRequest struct {
+	Node       string `json:"node"`   // requesting node
+	Client     uint64 `json:"client"` // client session number on requesting node
+	Hostname   string `json:"hostname"`
+	SessionID  []byte `json:"session_id"`
+	ClientIP   net.IP `json:"client_ip"`
+	ClientPort int    `json:"client_port"`
+	Relay      string `json:"relay,omitempty"` // relay node address, control node if empty
+}
+
+// Request to attach a server data session to a pending client on another node
+type nodeAttachRequest struct {
+	Hostname  string `json:"hostname"`
+	SessionID []byte `json:"session_id"`
+}
+
+// Split host and port of a relay address
+func splitRelayAddr(addr string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %s", p)
+	}
+	return host, port, nil
+}
+
+// Tag of a node in session IDs of its clients
+func nodeTag(id string) []byte {
+	h := sha256.Sum256([]byte(id))
+	return h[:nodeTagSize]
+}
+
+// Check whether an address is the relay address of this or another known node
+func knownRelay(addr string) bool {
+	if addr == *clusterRelay {
+		return true
+	}
+	for _, n := range cluster.nodes() {
+		if n.Relay == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a hostname is the relay address of this node
+func isRelayHost(hostname string) bool {
+	host, _, err := net.SplitHostPort(*clusterRelay)
+	return err == nil && strings.EqualFold(host, hostname)
+}
+
+// Choose the relay node for a client of a server on another node.
+// Empty address lets the control node relay by itself.
+func chooseRelay(control clusterNode) string {
+	switch *relaySteering {
+	case steerControl:
+		return control.Relay
+	case steerLeast:
+		best, load := *clusterRelay, sessions.clientCount()
+		for _, n := range cluster.nodes() {
+			if n.Relay != "" && (best == "" || n.Load < load) {
+				best, load = n.Relay, n.Load
+			}
+		}
+		return best
+	default:
+		return *clusterRelay
+	}
+}
+
+// Ask the control node of a remote server to signal it for a local client
+func requestRemote(num uint64, hostname string, suffix string, conn net.Conn, ch chan clientCommand, node clusterNode) error {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("failed to get client address")
+	}
+	id, err := sessions.remoteRequest(num, hostname, suffix, conn, ch)
+	if err != nil {
+		return err
+	}
+	req := nodeRelayRequest{Node: nodeID(), Client: num, Hostname: hostname, SessionID: id, ClientIP: addr.IP, ClientPort: addr.Port, Relay: chooseRelay(node)}
+	if err := postNode(node.Addr, "/relay", req); err != nil {
+		sessions.delRequest(num)
+		return fmt.Errorf("%w (%s): %s", errServerRemote, node.ID, err)
+	}
+	relay := req.Relay
+	if relay == "" {
+		relay = "control node"
+	}
+	lg.Session(num, 'C', "hostname", hostname, "suffix", suffix, "node", node.ID).Info("client.remote", 2, "Server is on node %s, relaying via %s", node.ID, relay)
+	return nil
+}
+
+// Post a JSON request to another node
+func postNode(addr string, path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+*clusterSecret)
+	client := http.Client{Timeout: nodeDialTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New(string(bytes.TrimSpace(msg)))
+	}
+	return nil
+}
+
+// Signal a local server for a client on another node
+func handleNodeRelay(w http.ResponseWriter, r *http.Request) {
+	if !clusterAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req nodeRelayRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNodeRequestSize)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	command := serverCommand{op: serverRelay, num: req.Client, hostname: req.Hostname, sessionID: req.SessionID, clientIP: req.ClientIP, clientPort: req.ClientPort}
+	if req.Relay != "" {
+		// Servers must not be sent to arbitrary addresses
+		if !knownRelay(req.Relay) {
+			http.Error(w, "unknown relay address", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if command.relayAddress, command.relayPort, err = splitRelayAddr(req.Relay); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := sessions.relayRequest(command); err != nil {
+		metricClientRejected.Add(err.Error(), 1)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	lg.Printf("Relay request from node %s for client session %d of %s", req.Node, req.Client, req.Hostname)
+}
+
+// Find the node with the pending client by the tag in the session ID and open a stream to it.
+// Returns the stream and ID of the node.
+func attachRemote(hostname string, sessionID []byte) (net.Conn, string, error) {
+	for _, n := range cluster.nodes() {
+		if !bytes.HasPrefix(sessionID, nodeTag(n.ID)) {
+			continue
+		}
+		if stream, err := attachNode(n.Addr, nodeAttachRequest{Hostname: hostname, SessionID: sessionID}); err == nil {
+			return stream, n.ID, nil
+		}
+	}
+	return nil, "", errors.New("client session not found on other nodes")
+}
+
+// Open a stream to a node for a pending client
+func attachNode(addr string, v nodeAttachRequest) (net.Conn, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/attach", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", relayUpgrade)
+	req.Header.Set("Authorization", "Bearer "+*clusterSecret)
+
+	conn, err := net.DialTimeout("tcp", addr, nodeDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(nodeDialTimeout))
+	br := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(br, req)
+	}
+	if err == nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		err = errors.New(resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Data after the response may have been buffered.
+	// peekedConn passes half-close on to the TCP connection.
+	var buffered []byte
+	if n := br.Buffered(); n > 0 {
+		buffered, _ = br.Peek(n)
+	}
+	return newPeekedConn(conn, buffered), nil
+}
+
+// Take over a stream from another node as the server data session of a pending client
+func handleNodeAttach(w http.ResponseWriter, r *http.Request) {
+	if !clusterAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req nodeAttachRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNodeRequestSize)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !sessions.hasPending(req.Hostname, req.SessionID) {
+		http.Error(w, "client session not found", http.StatusNotFound)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", relayUpgrade); err != nil {
+		return
+	}
+	// Hijacked connection is TCP, peekedConn passes half-close on to it
+	var buffered []byte
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ = rw.Reader.Peek(n)
+	}
+
+	num := connNum.Add(1)
+	sess := lg.Session(num, 'S', "hostname", req.Hostname, "remote_ip", ipString(conn.RemoteAddr()))
+	sess.Info("data.start", 1, "Starting server data session from node at %s", conn.RemoteAddr())
+	if !relayPending(num, newPeekedConn(conn, buffered), req.Hostname, req.SessionID, sess) {
+		sess.Warn("data.not_found", 3, "Session aborted: can't find the client session")
+	}
+}
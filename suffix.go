@@ -7,7 +7,10 @@ import (
 	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
@@ -17,7 +20,12 @@ type suffix struct {
 	suffix   string          // azure suffix (e.g. .myazure.net)
 	control  string          // server FQDN (e.g. control.myazure.net)
 	certs    tls.Certificate // server cert chain
-	certHash [20]byte
+	certHash [20]byte        // SHA-1 of the leaf certificate sent in relay signals
+
+	// Optional settings
+	rate      int64     // bandwidth of the whole suffix in bytes per second
+	geoClient geoPolicy // location policy of VPN clients
+	geoServer geoPolicy // location policy of VPN servers
 }
 
 // DNS suffix list with mutex
@@ -40,7 +48,7 @@ func (su *suffixList) read(file string) int {
 	scanner := bufio.NewScanner(f)
 
 	for scanner.Scan() {
-		// Format: DNS suffix[TAB]control address[TAB]certificate chain file[TAB]private key file
+		// Format: DNS suffix[TAB]control address[TAB]certificate chain file[TAB]private key file[TAB]options...
 		line := strings.Split(scanner.Text(), "	")
 
 		if len(line) < 4 {
@@ -52,20 +60,67 @@ func (su *suffixList) read(file string) int {
 		}
 
 		// A suffix must start with "."
-		if strings.HasPrefix(line[0], ".") {
-			if certs, err := tls.LoadX509KeyPair(line[2], line[3]); err == nil {
-				certs.Leaf, _ = x509.ParseCertificate(certs.Certificate[0])
-				hash := sha1.Sum(certs.Certificate[0])
-				su.list = append(su.list, suffix{suffix: strings.ToLower(line[0]), control: strings.ToLower(line[1]), certs: certs, certHash: hash})
-			} else {
-				lg.Printf("suffix: error loading certificates for suffix %s: %s", line[0], err)
+		if !strings.HasPrefix(line[0], ".") {
+			continue
+		}
+
+		s := suffix{suffix: strings.ToLower(line[0]), control: strings.ToLower(line[1])}
+		opts, ignored := parseOptions(line[4:])
+		if err := s.parseOptions(opts); err != nil {
+			lg.Event(slog.LevelError, "suffix.invalid", fmt.Sprintf("suffix: error parsing options for suffix %s: %s", line[0], err), "suffix", line[0], "error", err.Error())
+			continue
+		}
+		for _, f := range ignored {
+			lg.Event(slog.LevelWarn, "suffix.ignored", fmt.Sprintf("suffix: ignoring field %s without value for suffix %s", f, line[0]), "suffix", line[0], "field", f)
+		}
+
+		// Certificates may be held by a TLS offloading proxy instead
+		if line[2] == "-" && line[3] == "-" {
+			if s.certHash == [20]byte{} {
+				lg.Event(slog.LevelError, "suffix.invalid", fmt.Sprintf("suffix: cert_hash is required for suffix %s without certificate", line[0]), "suffix", line[0], "error", "cert_hash is required")
+				continue
 			}
+			su.list = append(su.list, s)
+			continue
+		}
+
+		if certs, err := tls.LoadX509KeyPair(line[2], line[3]); err == nil {
+			certs.Leaf, _ = x509.ParseCertificate(certs.Certificate[0])
+			s.certs = certs
+			if s.certHash == [20]byte{} {
+				s.certHash = sha1.Sum(certs.Certificate[0])
+			}
+			su.list = append(su.list, s)
+		} else {
+			lg.Event(slog.LevelError, "suffix.invalid", fmt.Sprintf("suffix: error loading certificates for suffix %s: %s", line[0], err), "suffix", line[0], "error", err.Error())
 		}
 	}
 
 	return len(su.list)
 }
 
+// Parse optional settings
+func (s *suffix) parseOptions(opts options) (err error) {
+	if s.rate, err = opts.size("rate"); err != nil {
+		return err
+	}
+	if v, ok := opts["cert_hash"]; ok {
+		// SHA-1 of the certificate presented to VPN servers, for TLS offloading
+		b, err := hex.DecodeString(strings.ReplaceAll(v, ":", ""))
+		if err != nil || len(b) != len(s.certHash) {
+			return fmt.Errorf("option cert_hash: invalid SHA-1 hash %s", v)
+		}
+		copy(s.certHash[:], b)
+	}
+	if s.geoClient, err = opts.geoPolicy("geo_client"); err != nil {
+		return err
+	}
+	if s.geoServer, err = opts.geoPolicy("geo_server"); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Look up suffix or server based on SNI.
 // Parsed hostname is in lower case (e.g. vpn1234.myazure.net).
 func (su *suffixList) parse(sni string) (hostname string, suffix *suffix, server bool, ok bool) {
@@ -104,3 +159,17 @@ func (su *suffixList) get(suffix string) *suffix {
 
 	return nil
 }
+
+// Get the first suffix with a location policy, empty if none
+func (su *suffixList) geoPolicy() string {
+	su.rw.RLock()
+	defer su.rw.RUnlock()
+
+	for i := range su.list {
+		if su.list[i].geoClient.set() || su.list[i].geoServer.set() {
+			return su.list[i].suffix
+		}
+	}
+
+	return ""
+}
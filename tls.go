@@ -7,21 +7,39 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 )
 
 // Get TLS configuration based on SNI
-func getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
-	if hello.ServerName == "" {
+func (l *listener) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	serverName := hello.ServerName
+	if serverName == "" {
+		serverName = l.host
+	}
+	if serverName == "" {
 		return nil, errors.New("SNI is empty")
 	}
 
-	_, suffix, server, ok := suffixes.parse(hello.ServerName)
+	hostname, suffix, server, ok := suffixes.parse(serverName)
 	if !ok {
-		return nil, fmt.Errorf("SNI %s does not match any suffix", hello.ServerName)
+		return nil, fmt.Errorf("SNI %s does not match any suffix", serverName)
+	}
+	if err := l.allow(server, suffix.suffix); err != nil {
+		return nil, err
+	}
+
+	certs := suffix.certs
+	if hello.ServerName == "" && l.cert != nil {
+		certs = *l.cert
+	}
+
+	// Suffixes without certificate are served by TLS offloading proxies only
+	if len(certs.Certificate) == 0 {
+		return nil, fmt.Errorf("suffix %s has no certificate", suffix.suffix)
 	}
 
-	config := &tls.Config{Certificates: []tls.Certificate{suffix.certs}}
+	config := &tls.Config{Certificates: []tls.Certificate{certs}}
 
 	// Request client certificate from azure clients
 	if server {
@@ -29,9 +47,27 @@ func getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
 		config.VerifyConnection = verifyClientCertificate
 	}
 
+	// Require certificate from VPN clients of protected hostnames.
+	// Tickets are shared by all hostnames and would skip verification against this CA.
+	if !server {
+		if info, ok := auths.find(hostname, suffix.suffix); ok && info.clientCA != nil {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+			config.ClientCAs = info.clientCA
+			config.SessionTicketsDisabled = true
+		}
+	}
+
 	return config, nil
 }
 
+// Get peer certificates of a TLS connection, none if TLS is offloaded
+func peerCertificates(conn net.Conn) []*x509.Certificate {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState().PeerCertificates
+	}
+	return nil
+}
+
 // Verify azure client certificate if presented
 func verifyClientCertificate(cs tls.ConnectionState) error {
 	_, suffix, server, ok := suffixes.parse(cs.ServerName)
@@ -0,0 +1,221 @@
+// Zero-downtime upgrade by handing listening sockets to a new process
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envInherit       = "VPNAZURE_INHERIT"  // addresses of inherited listeners, in order of their file descriptors
+	envConnNum       = "VPNAZURE_CONN_NUM" // last session number of the old process
+	inheritReadyFd   = 3                   // pipe to tell the old process that listeners are up
+	upgradeTimeout   = time.Minute
+	drainLogInterval = 10 * time.Minute
+)
+
+// Path of the running binary, resolved before it gets replaced
+var executable, _ = os.Executable()
+
+// Listeners that can be handed to a new process
+var handoff struct {
+	mu        sync.Mutex
+	inherited map[string]net.Listener // by address, not opened again yet
+	listeners []net.Listener
+	addrs     []string
+	ready     *os.File // readiness pipe of an upgrade
+	upgraded  bool
+}
+
+// Take over listeners from an old process if started by an upgrade
+func inheritListeners() error {
+	handoff.inherited = make(map[string]net.Listener)
+	list := os.Getenv(envInherit)
+	if list == "" {
+		return nil
+	}
+	os.Unsetenv(envInherit)
+	handoff.ready = os.NewFile(inheritReadyFd, "ready")
+	for i, addr := range strings.Split(list, ",") {
+		f := os.NewFile(uintptr(inheritReadyFd+1+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherit listener %s: %w", addr, err)
+		}
+		handoff.inherited[addr] = l
+	}
+	if n, err := strconv.ParseUint(os.Getenv(envConnNum), 10, 64); err == nil {
+		connNum.Store(n)
+	}
+	os.Unsetenv(envConnNum)
+	lg.Printf("Inherited %d listeners from process %d", len(handoff.inherited), os.Getppid())
+	return nil
+}
+
+// Listen on a TCP address or take the inherited listener of it
+func listen(addr string) (net.Listener, error) {
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+
+	l, ok := handoff.inherited[addr]
+	if ok {
+		delete(handoff.inherited, addr)
+	} else {
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	handoff.listeners = append(handoff.listeners, l)
+	handoff.addrs = append(handoff.addrs, addr)
+	return l, nil
+}
+
+// Close unused inherited listeners and let the old process drain
+func notifyReady() {
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+
+	for addr, l := range handoff.inherited {
+		lg.Printf("Closed inherited listener %s that is no longer configured", addr)
+		l.Close()
+	}
+	handoff.inherited = nil
+	if handoff.ready != nil {
+		handoff.ready.Write([]byte{1})
+		handoff.ready.Close()
+		handoff.ready = nil
+	}
+}
+
+// Stop accepting connections
+func closeListeners() {
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+
+	for _, l := range handoff.listeners {
+		l.Close()
+	}
+}
+
+// Start the binary again with the listening sockets and stop accepting connections once it is up.
+// Relays keep running until they end.
+func upgrade() error {
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+
+	if handoff.upgraded {
+		return errors.New("already upgraded")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files := []*os.File{w}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range handoff.listeners {
+		f, err := l.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), envInherit+"="+strings.Join(handoff.addrs, ","), envConnNum+"="+strconv.FormatUint(connNum.Load(), 10))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	w.Close()
+
+	// The pipe closes without data if the new process fails to start
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process %d failed to start", cmd.Process.Pid)
+	}
+	go cmd.Wait()
+
+	handoff.upgraded = true
+	for _, l := range handoff.listeners {
+		l.Close()
+	}
+	lg.Printf("Handed listeners over to process %d", cmd.Process.Pid)
+	go drain()
+	return nil
+}
+
+// Move servers to the new process gradually and exit when relays are done
+func drain() {
+	cluster.stop()
+
+	// Spread reconnects of servers to avoid a storm on the new process
+	hosts := sessions.serverHosts()
+	interval := *upgradeSpread
+	if len(hosts) > 0 {
+		interval /= time.Duration(len(hosts))
+	}
+	lg.Printf("Draining %d servers and %d clients", len(hosts), sessions.clientCount())
+	for {
+		// Servers may still register from connections accepted before the handoff
+		hosts := sessions.serverHosts()
+		if len(hosts) == 0 {
+			break
+		}
+		sessions.closeServer(hosts[0], "moved to the new process")
+		if len(hosts) > 1 {
+			time.Sleep(interval)
+		}
+	}
+
+	// Long-lived relays must not keep the old process forever
+	deadline := time.Now().Add(*upgradeMaxDrain)
+	logged := time.Now()
+	for n := sessions.clientCount(); n > 0; n = sessions.clientCount() {
+		if time.Now().After(deadline) {
+			lg.Event(slog.LevelWarn, "upgrade.drain_timeout", fmt.Sprintf("Drain timeout, closing %d relays", n), "clients", n)
+			break
+		}
+		if time.Since(logged) >= drainLogInterval {
+			lg.Printf("Draining, %d clients remaining", n)
+			logged = time.Now()
+		}
+		time.Sleep(time.Second)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimeout)
+	waitControls(ctx)
+	cancel()
+	saveStores()
+	lg.Println("Drained, exiting")
+	lg.Close()
+	os.Exit(0)
+}
+
+// Write process ID for process supervisors
+func writePidFile() {
+	if *pidFile == "" {
+		return
+	}
+	if err := os.WriteFile(*pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		lg.Event(slog.LevelError, "pidfile.failed", fmt.Sprintf("Failed to write pid file: %s", err), "file", *pidFile, "error", err.Error())
+	}
+}
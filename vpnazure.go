@@ -1,43 +1,133 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/netip"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"vpnazure-go/internal/logger"
+
+	"golang.org/x/time/rate"
 )
 
-var listenAddr = flag.String("b", "", "Listening address and port")
+var listenAddrs = listenerFlags("b", modeTLS, "Listening `address` and port, repeatable, with optional ,role=client|server|all ,suffix=.example.net ,name=label ,host=vpn1.example.net ,cert=file ,key=file")
 var suffixFile = flag.String("suffix", "", "File that contains DNS suffixes of the service")
 var authFile = flag.String("auth", "", "File that contains server credentials")
 var logFile = flag.String("log", "", "Path to the log file")
+var passthroughFile = flag.String("passthrough", "", "File that contains backends for SNIs not matching any suffix")
+var adminAddr = flag.String("admin", "", "Listening address and port of the admin API (e.g. 127.0.0.1:8080)")
+var flapLimit = flag.Int("flap-limit", 0, "Registrations of a hostname within the flap window that mark it as flapping (0 to disable)")
+var flapWindow = flag.Duration("flap-window", 10*time.Minute, "Time window for counting server registrations")
+var flapDelay = flag.Duration("flap-delay", 10*time.Second, "Delay before accepting registration of a flapping hostname (less than 30s)")
+var flapHold = flag.Duration("flap-hold", time.Minute, "Minimum interval between registrations of a flapping hostname")
+var relayIdle = flag.Duration("relay-idle", 10*time.Minute, "Close relays without traffic in either direction for this long (0 to disable)")
+var relayMax = flag.Duration("relay-max", 0, "Maximum duration of a relay (0 for unlimited)")
+var globalRate = sizeFlag("rate", 0, "Bandwidth of all relays in bytes per second, K/M/G suffixes allowed (0 for unlimited)")
+var maxHostRelays = flag.Int("max-relays", 0, "Maximum concurrent relays of each hostname (0 for unlimited)")
+var maxHostPending = flag.Int("max-pending", 0, "Maximum pending client requests of each hostname (0 for unlimited)")
+var hostConnRate = flag.Float64("conn-rate", 0, "Maximum new client connections per second of each hostname (0 for unlimited)")
+var geoFiles = flag.String("geoip", "", "MaxMind format GeoIP databases (country and/or ASN), comma separated")
+var geoClientAllow = flag.String("geo-client-allow", "", "Country codes and AS numbers (e.g. JP,AS64500) that VPN clients may connect from")
+var geoClientDeny = flag.String("geo-client-deny", "", "Country codes and AS numbers that VPN clients may not connect from")
+var geoServerAllow = flag.String("geo-server-allow", "", "Country codes and AS numbers that VPN servers may register from")
+var geoServerDeny = flag.String("geo-server-deny", "", "Country codes and AS numbers that VPN servers may not register from")
+var offloadAddrs = listenerFlags("offload", modeOffload, "Listening `address` and port for plaintext connections from a TLS offloading proxy, repeatable with the same options as -b")
+var connectAddrs = listenerFlags("connect", modeConnect, "Listening `address` and port for VPN clients behind HTTP proxies (HTTP CONNECT), repeatable with the same options as -b")
+var proxyFromList = flag.String("proxy-from", "", "Networks of trusted load balancers that send PROXY protocol headers, comma separated")
+var usageFile = flag.String("usage", "", "File to save monthly traffic usage for quotas")
+var sessionRate = sizeFlag("session-rate", 0, "Default bandwidth of each relay in bytes per second, K/M/G suffixes allowed (0 for unlimited)")
+var handshakeTimeout = flag.Duration("handshake-timeout", 10*time.Second, "Time allowed from accepting a connection to completing TLS handshake")
+var maxPreauth = flag.Int("max-preauth", 0, "Maximum concurrent connections before authentication (0 for unlimited)")
+var maxSourcePreauth = flag.Int("max-preauth-per-ip", 0, "Maximum concurrent connections before authentication from each IP address (0 for unlimited)")
+var sourceConnRate = flag.Float64("ip-conn-rate", 0, "Maximum new connections per second from each IP address (0 for unlimited)")
+var unknownSNI = flag.String("unknown-sni", unknownReject, "Action on unknown or empty SNI: reject, tarpit or decoy")
+var tarpitTime = flag.Duration("tarpit", time.Minute, "How long connections with unknown SNI are held in tarpit")
+var maxTarpits = flag.Int("max-tarpits", 1024, "Maximum connections held in tarpit, others are rejected")
+var decoyCert = flag.String("decoy-cert", "", "Certificate presented to unknown SNIs in decoy mode (self-signed if not set)")
+var decoyKey = flag.String("decoy-key", "", "Private key of the decoy certificate")
+var blockAfter = flag.Int("block-after", 0, "Unknown SNIs from an IP address within block time that get it blocked (0 to disable)")
+var blockTime = flag.Duration("block-time", time.Hour, "How long repeat offenders are blocked")
+var fingerprintDenyList = flag.String("fp-deny", "", "JA3 hashes or JA4 fingerprints to drop before TLS handshake, comma separated, * for prefix")
+var clusterBackend = flag.String("cluster", "", "Share server registrations with other relay nodes by backend: gossip")
+var clusterNodeID = flag.String("cluster-node", "", "Unique ID of this node in the cluster (hostname if empty)")
+var clusterAddr = flag.String("cluster-addr", "", "Listening address and port for other nodes, must be reachable by them (e.g. 10.0.0.1:7946)")
+var clusterPeers = flag.String("cluster-peers", "", "Cluster addresses of other nodes to join, comma separated")
+var clusterSecret = flag.String("cluster-secret", "", "Shared secret of the cluster, required with -cluster")
+var clusterRelay = flag.String("cluster-relay", "", "Address and port that VPN servers open data sessions to on this node, covered by a suffix certificate (e.g. node1.myazure.net:443)")
+var relaySteering = flag.String("relay-steering", steerClient, "Node that relays clients of servers on other nodes: client (where the client is), control (where the server is) or least (least loaded)")
+var upgradeSpread = flag.Duration("upgrade-spread", 30*time.Second, "Time over which servers are moved to the new process after an upgrade (SIGUSR1)")
+var upgradeMaxDrain = flag.Duration("upgrade-max-drain", 24*time.Hour, "How long relays may continue in the old process after an upgrade")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long relays may continue after a SIGTERM or SIGINT")
+var statsFile = flag.String("stats", "", "Database file to keep statistics of hostnames across restarts")
+var statsRetention = flag.Duration("stats-retention", 90*24*time.Hour, "How long statistics of hostnames not seen are kept (0 to keep forever)")
+var historyFile = flag.String("history", "", "Database file to record control, relay and refused client sessions")
+var historyRetention = flag.Duration("history-retention", 30*24*time.Hour, "How long session records are kept (0 to keep forever)")
+var pidFile = flag.String("pid-file", "", "File to write the process ID to, updated by upgrades")
+var logFormat = flag.String("log-format", "text", "Format of the log: text or json (one object per line)")
+var logLevel = flag.String("log-level", "info", "Minimum level of logged events: debug, info, warn or error")
 var version = "unknown"
 var build = "unknown"
 
 // Global variables are thread-safe
 var (
-	lg       logger.Logger
-	suffixes suffixList
-	auths    authList
-	sessions sessionList
+	lg              logger.Logger
+	suffixes        suffixList
+	auths           authList
+	sessions        sessionList
+	passthroughs    passthroughList
+	bandwidth       shaper
+	usage           usageStore
+	geo             geoDB
+	geoClient       geoPolicy // global location policy of VPN clients
+	geoServer       geoPolicy // global location policy of VPN servers
+	proxyFrom       []netip.Prefix
+	preauth         preauthList
+	blocks          blocklist
+	fingerprintDeny fingerprintPolicy // known scanners
+	cluster         registry
+	localTag        []byte // tag of this node in session IDs, nil without cluster
+	drains          drainList
+	stats           statsStore
+	history         historyStore
 )
 
 func main() {
 	flag.Parse()
-	if flag.NArg() > 0 || len(os.Args) == 1 {
-		fmt.Fprintf(os.Stderr, "vpnazure-go version %s (build %s) usage:\n", version, build)
-		flag.PrintDefaults()
-		os.Exit(1)
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Args())
+		if errors.Is(err, errUnknownCommand) {
+			printUsage()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) == 1 {
+		printUsage()
 	}
 
 	// Open log file or write to stdout
+	if err := initLog(); err != nil {
+		log.Fatalln(err)
+	}
 	lg.Open(*logFile, true)
 	defer lg.Close()
 
+	// Take over listening sockets from an upgraded process
+	if err := inheritListeners(); err != nil {
+		log.Fatalln(err)
+	}
+
 	// Read DNS suffix from file
 	if n := suffixes.read(*suffixFile); n > 0 {
 		lg.Printf("Loaded %d suffixes", n)
@@ -52,59 +142,116 @@ func main() {
 		log.Fatalf("At least 1 server credential is needed")
 	}
 
-	go listenSignal()
+	// Load GeoIP databases and location policies
+	if err := geo.open(*geoFiles); err != nil {
+		log.Fatalln(err)
+	}
+	var err error
+	if geoClient, err = parseGeoPolicy(*geoClientAllow, *geoClientDeny); err != nil {
+		log.Fatalln(err)
+	}
+	if geoServer, err = parseGeoPolicy(*geoServerAllow, *geoServerDeny); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkGeoPolicies(); err != nil {
+		log.Fatalln(err)
+	}
 
-	// Start listener
-	config := &tls.Config{GetConfigForClient: getConfigForClient}
-	listener, err := tls.Listen("tcp", *listenAddr, config)
-	if err != nil {
+	if proxyFrom, err = parsePrefixes(*proxyFromList); err != nil {
 		log.Fatalln(err)
 	}
+	if err := initUnknownSNI(); err != nil {
+		log.Fatalln(err)
+	}
+	// Flapping servers must register before their control sessions time out
+	if *flapDelay < 0 || *flapDelay >= serverTimeout {
+		log.Fatalf("Flap delay must be less than %s", serverTimeout)
+	}
+	fingerprintDeny.deny = parseFingerprints(*fingerprintDenyList)
 
-	// Print session status with ticker
+	// Read passthrough backends
+	if *passthroughFile != "" {
+		lg.Printf("Loaded %d passthrough backends", passthroughs.read(*passthroughFile))
+	}
+
+	go listenSignal()
+
+	// Print session status and forget old registrations with ticker
 	go func() {
 		ticker := time.Tick(15 * time.Minute)
 		for range ticker {
 			sessions.printStatus()
+			sessions.cleanupServers()
 		}
 	}()
 
 	sessions.servers = make(map[string]serverSession)
 	sessions.relaying = make(map[uint64]relayingSession)
 	sessions.pending = make(map[uint64]pendingSession)
+	sessions.flaps = make(map[string]*flapState)
+	sessions.connRate = make(map[string]*rate.Limiter)
+	sessions.load = make(map[string]*hostLoad)
+	bandwidth.init(*globalRate, *sessionRate)
+	if err := usage.open(*usageFile); err != nil {
+		log.Fatalln(err)
+	}
+	if err := stats.open(*statsFile); err != nil {
+		log.Fatalln(err)
+	}
+	if err := history.open(*historyFile); err != nil {
+		log.Fatalln(err)
+	}
 
-	// connection counter
-	var num uint64
+	// Join cluster
+	if cluster, err = startCluster(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Start admin API
+	startAdmin()
 
-	for {
-		conn, err := listener.Accept()
+	// Start listeners
+	listeners := append(append(listenAddrs.list, offloadAddrs.list...), connectAddrs.list...)
+	if len(listeners) == 0 {
+		log.Fatalf("At least 1 listening address is needed")
+	}
+	for _, l := range listeners {
+		nl, err := listen(l.addr)
 		if err != nil {
-			lg.Println(err)
-			continue
-		}
-		if tlsConn, ok := conn.(*tls.Conn); ok {
-			num++
-			go func(num uint64) {
-				defer conn.Close()
-				if err := tlsConn.Handshake(); err != nil {
-					lg.PrintSessionf("TLS handshake failed: %s", num, ' ', 0, err)
-					return
-				}
-				state := tlsConn.ConnectionState()
-				hostname, suffix, server, ok := suffixes.parse(state.ServerName)
-				if !ok {
-					lg.PrintSessionf("SNI %s does not match any suffix", num, ' ', 0, state.ServerName)
-					return
-				}
-				if server {
-					handleServer(num, tlsConn, suffix)
-				} else {
-					handleClient(num, tlsConn, hostname)
-				}
-			}(num)
-		} else {
-			conn.Close()
+			log.Fatalln(err)
 		}
+		go l.serve(nl)
+	}
+	notifyReady()
+	writePidFile()
+
+	// Shut down gracefully on the first signal, a second one exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	lg.Println("Received signal to shut down")
+	shutdown()
+}
+
+// Check -log-format and -log-level
+func initLog() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("invalid log level: %s", *logLevel)
 	}
+	switch *logFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid log format: %s", *logFormat)
+	}
+	lg.SetFormat(*logFormat == "json", level)
+	return nil
+}
 
+// Print usage and exit
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "vpnazure-go version %s (build %s) usage:\n", version, build)
+	flag.PrintDefaults()
+	printCommands()
+	os.Exit(1)
 }